@@ -0,0 +1,84 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package auth contains the backends that usernames and passwords are checked against.
+package auth
+
+import (
+	"errors"
+	"fmt"
+
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/config"
+	"maunium.net/go/mauGFHS/db"
+)
+
+// ErrInvalidCredentials is returned when the user doesn't exist or the password is wrong.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// Authenticator is a backend that can check the password of a user.
+type Authenticator interface {
+	// Name returns the name of the authenticator used in the config and logs.
+	Name() string
+	// Authenticate returns the user with the given username if the password is correct.
+	Authenticate(username, password string) (*db.User, error)
+}
+
+var authenticators []Authenticator
+
+// Configure sets up the authenticators listed in the config. Only the local authenticator is used if
+// none are listed.
+func Configure(cfg config.AuthConfig) error {
+	names := cfg.Authenticators
+	if len(names) == 0 {
+		names = []string{"local"}
+	}
+	configured := make([]Authenticator, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case "local":
+			configured = append(configured, LocalAuthenticator{})
+		case "ldap":
+			ldap, err := NewLDAPAuthenticator(cfg.LDAP)
+			if err != nil {
+				return fmt.Errorf("failed to configure LDAP: %v", err)
+			}
+			configured = append(configured, ldap)
+		default:
+			return fmt.Errorf("unknown authenticator %s", name)
+		}
+	}
+	authenticators = configured
+	return nil
+}
+
+// Authenticate checks the username and password against each configured authenticator in order and
+// returns the user from the first one that accepts them.
+func Authenticate(username, password string) (*db.User, error) {
+	if len(username) == 0 || len(password) == 0 {
+		return nil, ErrInvalidCredentials
+	}
+	for _, authenticator := range authenticators {
+		user, err := authenticator.Authenticate(username, password)
+		if err == nil {
+			return user, nil
+		} else if err != ErrInvalidCredentials {
+			log.Errorf("%s authentication of %s failed: %v\n", authenticator.Name(), username, err)
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
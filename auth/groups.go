@@ -0,0 +1,82 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"fmt"
+
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/config"
+	"maunium.net/go/mauGFHS/db"
+)
+
+// SyncGroups updates the admin status and namespace permissions of the user based on their groups in
+// an external identity provider. Namespace permissions granted by groups the user is no longer in are
+// removed, but manual grants are never changed. The admin status is only synced if admin groups are
+// configured.
+func SyncGroups(user *db.User, groups []string, mapping config.GroupMapping, source string) {
+	admin := false
+	permissions := make(map[string]db.PermissionValue)
+	for _, group := range groups {
+		for _, adminGroup := range mapping.AdminGroups {
+			if group == adminGroup {
+				admin = true
+			}
+		}
+		for namespace, pv := range mapping.GroupPermissions[group] {
+			permissions[namespace] |= db.PermissionValue(pv)
+		}
+	}
+
+	if len(mapping.AdminGroups) > 0 && user.Admin != admin {
+		if err := user.SetAdmin(admin); err != nil {
+			log.Errorf("Failed to update admin status of %s: %v\n", user.Email, err)
+		} else {
+			log.Infof("Admin status of %s set to %t based on %s groups\n", user.Email, admin, source)
+			db.RecordAuditEvent(&db.AuditEvent{
+				Action:     db.AuditPermissionChanged,
+				TargetType: db.AuditTargetUser,
+				Target:     user.Email,
+				Details:    fmt.Sprintf("admin set to %t by %s groups", admin, source),
+			})
+		}
+	}
+	for namespace := range permissions {
+		if db.GetNamespace(namespace) == nil {
+			log.Warnf("Namespace %s in %s group permissions doesn't exist\n", namespace, source)
+			delete(permissions, namespace)
+		}
+	}
+	changes, err := user.SyncGroupNamespacePermissions(source, permissions)
+	if err != nil {
+		log.Errorf("Failed to sync %s group permissions of %s: %v\n", source, user.Email, err)
+		return
+	}
+	for namespace, pv := range changes {
+		details := fmt.Sprintf("%s granted permission %d by %s groups", user.Email, pv, source)
+		if pv == db.PermissionNothing {
+			details = fmt.Sprintf("%s permission removed by %s groups", user.Email, source)
+		}
+		db.RecordAuditEvent(&db.AuditEvent{
+			Action:     db.AuditPermissionChanged,
+			TargetType: db.TypeNamespacePermission.String(),
+			Target:     namespace,
+			Details:    details,
+		})
+	}
+}
@@ -0,0 +1,185 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/config"
+	"maunium.net/go/mauGFHS/db"
+)
+
+var errNoEmailAttribute = errors.New("LDAP entry doesn't have an email")
+
+// LDAPAuthenticator checks passwords by searching for the user in an LDAP directory and binding as
+// the found entry.
+type LDAPAuthenticator struct {
+	cfg       config.LDAPConfig
+	tlsConfig *tls.Config
+}
+
+// NewLDAPAuthenticator creates an LDAP authenticator with the given config.
+func NewLDAPAuthenticator(cfg config.LDAPConfig) (*LDAPAuthenticator, error) {
+	switch cfg.TLS {
+	case "", "none", "starttls", "ldaps":
+	default:
+		return nil, fmt.Errorf("unknown TLS mode %s", cfg.TLS)
+	}
+	if len(cfg.Address) == 0 {
+		return nil, errors.New("LDAP server address not configured")
+	}
+	host, _, err := net.SplitHostPort(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if len(cfg.CAFile) > 0 {
+		data, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+	return &LDAPAuthenticator{cfg: cfg, tlsConfig: tlsConfig}, nil
+}
+
+// Name returns "ldap".
+func (la *LDAPAuthenticator) Name() string {
+	return "ldap"
+}
+
+func (la *LDAPAuthenticator) connect() (*ldap.Conn, error) {
+	dialer := ldap.DialWithDialer(&net.Dialer{Timeout: la.cfg.GetTimeout()})
+	var conn *ldap.Conn
+	var err error
+	if la.cfg.TLS == "ldaps" {
+		conn, err = ldap.DialURL("ldaps://"+la.cfg.Address, dialer, ldap.DialWithTLSConfig(la.tlsConfig))
+	} else {
+		conn, err = ldap.DialURL("ldap://"+la.cfg.Address, dialer)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(la.cfg.GetTimeout())
+	if la.cfg.TLS == "starttls" {
+		if err = conn.StartTLS(la.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Authenticate searches for the user with the configured filter and binds as the entry with the
+// given password. If the user doesn't exist in mauGFHS, it's created if auto-provisioning is enabled.
+func (la *LDAPAuthenticator) Authenticate(username, password string) (*db.User, error) {
+	entry, err := la.checkPassword(username, password)
+	if err != nil {
+		return nil, err
+	}
+	email := entry.GetAttributeValue(la.cfg.GetEmailAttribute())
+	if len(email) == 0 {
+		return nil, errNoEmailAttribute
+	}
+	user := db.GetUser(email)
+	if user == nil {
+		if !la.cfg.AutoProvision {
+			return nil, ErrInvalidCredentials
+		}
+		user, err = db.CreateUser(email)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Provisioned user %s from LDAP login\n", user.Email)
+	} else if user.ServiceAccount {
+		return nil, ErrInvalidCredentials
+	}
+	if len(la.cfg.GroupAttribute) > 0 {
+		SyncGroups(user, entry.GetAttributeValues(la.cfg.GroupAttribute), la.cfg.GroupMapping, "LDAP")
+	}
+	return user, nil
+}
+
+// checkPassword finds the entry of the user and checks the password by binding as the entry.
+func (la *LDAPAuthenticator) checkPassword(username, password string) (*ldap.Entry, error) {
+	// An empty password would make the bind unauthenticated, which most servers accept.
+	if len(password) == 0 {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := la.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	entry, err := la.findUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// findUser binds as the search account and finds the single entry matching the username.
+func (la *LDAPAuthenticator) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	var err error
+	if len(la.cfg.BindDN) > 0 {
+		err = conn.Bind(la.cfg.BindDN, la.cfg.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind as search account: %v", err)
+	}
+
+	attributes := []string{la.cfg.GetEmailAttribute()}
+	if len(la.cfg.GroupAttribute) > 0 {
+		attributes = append(attributes, la.cfg.GroupAttribute)
+	}
+	filter := strings.Replace(la.cfg.GetUserFilter(), "%s", ldap.EscapeFilter(username), -1)
+	req := ldap.NewSearchRequest(la.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(la.cfg.GetTimeout().Seconds()), false, filter, attributes, nil)
+	result, err := conn.Search(req)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("multiple entries match %s", username)
+	} else if err != nil {
+		return nil, err
+	} else if len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	return result.Entries[0], nil
+}
@@ -0,0 +1,231 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+
+	"maunium.net/go/mauGFHS/config"
+)
+
+// LDAP protocol operations and result codes used by the test server.
+const (
+	ldapBindRequest      ber.Tag = 0
+	ldapBindResponse     ber.Tag = 1
+	ldapUnbindRequest    ber.Tag = 2
+	ldapSearchRequest    ber.Tag = 3
+	ldapSearchResultItem ber.Tag = 4
+	ldapSearchResultDone ber.Tag = 5
+
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+const (
+	testSearchDN       = "cn=search,dc=example,dc=com"
+	testSearchPassword = "search password"
+	testUserDN         = "uid=alice,ou=people,dc=example,dc=com"
+	testUserPassword   = "alice password"
+)
+
+type testLDAPEntry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+// testLDAPServer is a minimal in-process LDAP server that supports simple binds and searches with
+// filters that exactly match one of the configured filters.
+type testLDAPServer struct {
+	listener  net.Listener
+	passwords map[string]string
+	entries   map[string][]testLDAPEntry
+}
+
+func newTestLDAPServer(t *testing.T) *testLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := testLDAPEntry{dn: testUserDN, attributes: map[string][]string{
+		"mail":     {"alice@example.com"},
+		"memberOf": {"cn=developers,ou=groups,dc=example,dc=com"},
+	}}
+	server := &testLDAPServer{
+		listener: listener,
+		passwords: map[string]string{
+			testSearchDN: testSearchPassword,
+			testUserDN:   testUserPassword,
+		},
+		entries: map[string][]testLDAPEntry{
+			"(uid=alice)": {alice},
+			"(uid=dup)":   {alice, {dn: "uid=dup,ou=people,dc=example,dc=com"}},
+			// Only matched if the username isn't escaped.
+			"(uid=*)": {alice},
+		},
+	}
+	go server.serve()
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	return server
+}
+
+func (server *testLDAPServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *testLDAPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		msgID := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldapBindRequest:
+			dn, _ := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := ldapInvalidCredentials
+			if expected, ok := server.passwords[dn]; (ok && expected == password) || (len(dn) == 0 && len(password) == 0) {
+				code = ldapSuccess
+			}
+			conn.Write(ldapMessage(msgID, ldapResult(ldapBindResponse, code)))
+		case ldapSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			for _, entry := range server.entries[filter] {
+				conn.Write(ldapMessage(msgID, entry.encode()))
+			}
+			conn.Write(ldapMessage(msgID, ldapResult(ldapSearchResultDone, ldapSuccess)))
+		case ldapUnbindRequest:
+			return
+		}
+	}
+}
+
+func ldapMessage(msgID int64, op *ber.Packet) []byte {
+	packet := ber.NewSequence("LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "Message ID"))
+	packet.AppendChild(op)
+	return packet.Bytes()
+}
+
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic message"))
+	return op
+}
+
+func (entry testLDAPEntry) encode() *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapSearchResultItem, nil, "Search result entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "DN"))
+	attributes := ber.NewSequence("Attributes")
+	for name, values := range entry.attributes {
+		attribute := ber.NewSequence("Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	op.AppendChild(attributes)
+	return op
+}
+
+func newTestLDAPAuthenticator(t *testing.T, server *testLDAPServer) *LDAPAuthenticator {
+	la, err := NewLDAPAuthenticator(config.LDAPConfig{
+		Address:        server.listener.Addr().String(),
+		TLS:            "none",
+		Timeout:        5 * time.Second,
+		BindDN:         testSearchDN,
+		BindPassword:   testSearchPassword,
+		BaseDN:         "ou=people,dc=example,dc=com",
+		GroupAttribute: "memberOf",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return la
+}
+
+func TestLDAPCheckPassword(t *testing.T) {
+	la := newTestLDAPAuthenticator(t, newTestLDAPServer(t))
+	entry, err := la.checkPassword("alice", testUserPassword)
+	if err != nil {
+		t.Fatal("Login with correct password failed:", err)
+	} else if entry.DN != testUserDN {
+		t.Errorf("Unexpected DN %s", entry.DN)
+	} else if email := entry.GetAttributeValue(la.cfg.GetEmailAttribute()); email != "alice@example.com" {
+		t.Errorf("Unexpected email %s", email)
+	} else if groups := entry.GetAttributeValues("memberOf"); len(groups) != 1 {
+		t.Errorf("Unexpected groups %v", groups)
+	}
+}
+
+func TestLDAPInvalidCredentials(t *testing.T) {
+	la := newTestLDAPAuthenticator(t, newTestLDAPServer(t))
+	tests := []struct {
+		name     string
+		username string
+		password string
+	}{
+		{"wrong password", "alice", "wrong"},
+		{"empty password", "alice", ""},
+		{"unknown user", "bob", testUserPassword},
+		{"multiple entries", "dup", testUserPassword},
+		{"wildcard", "*", testUserPassword},
+		{"filter injection", "alice)(uid=*", testUserPassword},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := la.checkPassword(test.username, test.password); err != ErrInvalidCredentials {
+				t.Errorf("Expected invalid credentials, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLDAPSearchBindFailure(t *testing.T) {
+	server := newTestLDAPServer(t)
+	la := newTestLDAPAuthenticator(t, server)
+	la.cfg.BindPassword = "wrong"
+	if _, err := la.checkPassword("alice", testUserPassword); err == nil || err == ErrInvalidCredentials {
+		t.Errorf("Expected search account bind error, got %v", err)
+	}
+}
+
+func TestLDAPUnknownTLSMode(t *testing.T) {
+	if _, err := NewLDAPAuthenticator(config.LDAPConfig{Address: "localhost:389", TLS: "ssl"}); err == nil {
+		t.Error("Unknown TLS mode was accepted")
+	}
+}
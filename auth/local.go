@@ -0,0 +1,47 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"golang.org/x/crypto/bcrypt"
+
+	"maunium.net/go/mauGFHS/db"
+)
+
+// dummyHash is compared against when the user doesn't exist, so that the response time doesn't
+// reveal which users exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("mauGFHS"), bcrypt.DefaultCost)
+
+// LocalAuthenticator checks passwords against the bcrypt hashes in the database.
+type LocalAuthenticator struct{}
+
+// Name returns "local".
+func (LocalAuthenticator) Name() string {
+	return "local"
+}
+
+// Authenticate checks the password of the user with the given email.
+func (LocalAuthenticator) Authenticate(username, password string) (*db.User, error) {
+	user := db.GetUser(username)
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	} else if !user.CheckPassword([]byte(password)) {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
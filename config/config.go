@@ -19,7 +19,10 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"strings"
+	"time"
 
 	"maunium.net/go/maulogger"
 
@@ -31,7 +34,290 @@ type Config struct {
 	Database DBConfig       `yaml:"database"`
 	Listen   ListenLocation `yaml:"listen"`
 	Logging  LogConfig      `yaml:"logging"`
+	Admin    AdminConfig    `yaml:"admin"`
+	Auth     AuthConfig     `yaml:"auth"`
 	DataPath string         `yaml:"dataPath"`
+	// How long the old names of renamed namespaces redirect to the new names.
+	NamespaceRedirectDuration time.Duration  `yaml:"namespaceRedirectDuration"`
+	FullTextIndex             FullTextConfig `yaml:"fullTextIndex"`
+	// How often expired files are deleted.
+	ReaperInterval time.Duration   `yaml:"reaperInterval"`
+	SignedURLs     SignedURLConfig `yaml:"signedURLs"`
+}
+
+// AuthConfig contains the settings for logging in.
+type AuthConfig struct {
+	// How long auth tokens issued when logging in are valid for.
+	TokenLifetime time.Duration `yaml:"tokenLifetime"`
+	// The authenticators that password logins are checked against, in order. Available
+	// authenticators are "local" and "ldap". Defaults to only local.
+	Authenticators []string   `yaml:"authenticators"`
+	LDAP           LDAPConfig `yaml:"ldap"`
+	OIDC           OIDCConfig `yaml:"oidc"`
+	TOTP           TOTPConfig `yaml:"totp"`
+	RateLimit      RateLimit  `yaml:"rateLimit"`
+	JWT            JWTConfig  `yaml:"jwt"`
+	Session        Session    `yaml:"session"`
+}
+
+// Session contains the settings for session cookies.
+type Session struct {
+	// The key used to sign session cookies. A random key is generated on startup if empty.
+	Key string `yaml:"key"`
+	// Whether or not session cookies may be sent over plain HTTP.
+	Insecure bool `yaml:"insecure"`
+}
+
+// JWTConfig contains the settings for self-contained JWT access tokens.
+type JWTConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// The issuer of the access tokens.
+	Issuer               string        `yaml:"issuer"`
+	AccessTokenLifetime  time.Duration `yaml:"accessTokenLifetime"`
+	RefreshTokenLifetime time.Duration `yaml:"refreshTokenLifetime"`
+	// How often a new signing key is generated. Old keys are kept until the tokens they signed expire.
+	KeyRotationInterval time.Duration `yaml:"keyRotationInterval"`
+}
+
+// GetIssuer gets the access token issuer, defaulting to mauGFHS.
+func (jc JWTConfig) GetIssuer() string {
+	if len(jc.Issuer) == 0 {
+		return "mauGFHS"
+	}
+	return jc.Issuer
+}
+
+// GetAccessTokenLifetime gets the lifetime of access tokens, defaulting to 5 minutes.
+func (jc JWTConfig) GetAccessTokenLifetime() time.Duration {
+	if jc.AccessTokenLifetime <= 0 {
+		return 5 * time.Minute
+	}
+	return jc.AccessTokenLifetime
+}
+
+// GetRefreshTokenLifetime gets the lifetime of refresh tokens, defaulting to 30 days.
+func (jc JWTConfig) GetRefreshTokenLifetime() time.Duration {
+	if jc.RefreshTokenLifetime <= 0 {
+		return 30 * 24 * time.Hour
+	}
+	return jc.RefreshTokenLifetime
+}
+
+// GetKeyRotationInterval gets how often signing keys are rotated, defaulting to a day.
+func (jc JWTConfig) GetKeyRotationInterval() time.Duration {
+	if jc.KeyRotationInterval <= 0 {
+		return 24 * time.Hour
+	}
+	return jc.KeyRotationInterval
+}
+
+// RateLimit contains the limits for failed authentication attempts. After the allowed number of
+// failures, each failure locks the IP address or account for twice as long as the previous one.
+type RateLimit struct {
+	// The number of failed logins and invalid tokens allowed from an IP address before it's locked.
+	IPFailures int `yaml:"ipFailures"`
+	// The number of failed logins allowed for an account before it's locked.
+	AccountFailures int `yaml:"accountFailures"`
+	// The length of the first lockout and the maximum length of lockouts.
+	BaseLockout time.Duration `yaml:"baseLockout"`
+	MaxLockout  time.Duration `yaml:"maxLockout"`
+	// How long after the last failure the failures are forgotten.
+	ResetAfter time.Duration `yaml:"resetAfter"`
+}
+
+// GetIPFailures gets the number of failures allowed per IP address, defaulting to 20.
+func (rl RateLimit) GetIPFailures() int {
+	if rl.IPFailures <= 0 {
+		return 20
+	}
+	return rl.IPFailures
+}
+
+// GetAccountFailures gets the number of failures allowed per account, defaulting to 5.
+func (rl RateLimit) GetAccountFailures() int {
+	if rl.AccountFailures <= 0 {
+		return 5
+	}
+	return rl.AccountFailures
+}
+
+// GetLockout gets the length of the lockout after the given number of failures over the limit,
+// starting from one.
+func (rl RateLimit) GetLockout(overLimit int) time.Duration {
+	lockout, max := rl.BaseLockout, rl.MaxLockout
+	if lockout <= 0 {
+		lockout = time.Second
+	}
+	if max <= 0 {
+		max = 15 * time.Minute
+	}
+	for i := 1; i < overLimit && lockout < max; i++ {
+		lockout *= 2
+	}
+	if lockout > max {
+		return max
+	}
+	return lockout
+}
+
+// GetResetAfter gets how long failures are remembered, defaulting to an hour.
+func (rl RateLimit) GetResetAfter() time.Duration {
+	if rl.ResetAfter <= 0 {
+		return time.Hour
+	}
+	return rl.ResetAfter
+}
+
+// TOTPConfig contains the settings for TOTP two-factor authentication.
+type TOTPConfig struct {
+	// The issuer name shown in authenticator apps.
+	Issuer string `yaml:"issuer"`
+	// Whether or not admin privileges are only granted to admins who have enabled TOTP.
+	RequireForAdmins bool `yaml:"requireForAdmins"`
+}
+
+// GetIssuer gets the TOTP issuer name, defaulting to mauGFHS.
+func (tc TOTPConfig) GetIssuer() string {
+	if len(tc.Issuer) == 0 {
+		return "mauGFHS"
+	}
+	return tc.Issuer
+}
+
+// GetTokenLifetime gets the lifetime of auth tokens, defaulting to 30 days.
+func (ac AuthConfig) GetTokenLifetime() time.Duration {
+	if ac.TokenLifetime <= 0 {
+		return 30 * 24 * time.Hour
+	}
+	return ac.TokenLifetime
+}
+
+// OIDCConfig contains the settings for logging in with an OpenID Connect provider.
+type OIDCConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"clientID"`
+	ClientSecret string   `yaml:"clientSecret"`
+	RedirectURL  string   `yaml:"redirectURL"`
+	Scopes       []string `yaml:"scopes"`
+	// Where to redirect the user after logging in. If empty, the auth token is returned as JSON.
+	PostLoginRedirect string `yaml:"postLoginRedirect"`
+	// Whether or not to create users that log in for the first time.
+	AutoProvision bool `yaml:"autoProvision"`
+	// The ID token claim that contains the groups of the user. Groups aren't used if empty.
+	GroupsClaim string `yaml:"groupsClaim"`
+	// Whether or not to accept emails that the provider doesn't mark as verified.
+	AllowUnverifiedEmail bool `yaml:"allowUnverifiedEmail"`
+	GroupMapping         `yaml:",inline"`
+}
+
+// LDAPConfig contains the settings for authenticating users against an LDAP directory.
+type LDAPConfig struct {
+	// The host:port of the LDAP server.
+	Address string `yaml:"address"`
+	// How to secure the connection: "none", "starttls" or "ldaps".
+	TLS string `yaml:"tls"`
+	// A PEM file with the CA certificates to trust. The system roots are used if empty.
+	CAFile             string        `yaml:"caFile"`
+	InsecureSkipVerify bool          `yaml:"insecureSkipVerify"`
+	Timeout            time.Duration `yaml:"timeout"`
+	// The account used to search for users. The search is done anonymously if empty.
+	BindDN       string `yaml:"bindDN"`
+	BindPassword string `yaml:"bindPassword"`
+	// Where to search for users and the search filter. %s in the filter is replaced with the
+	// escaped username.
+	BaseDN     string `yaml:"baseDN"`
+	UserFilter string `yaml:"userFilter"`
+	// The attribute that contains the email of the user, which is used as the mauGFHS username.
+	EmailAttribute string `yaml:"emailAttribute"`
+	// Whether or not to create users that log in for the first time.
+	AutoProvision bool `yaml:"autoProvision"`
+	// The attribute of the user entry that lists the groups of the user. Groups aren't used if empty.
+	GroupAttribute string `yaml:"groupAttribute"`
+	GroupMapping   `yaml:",inline"`
+}
+
+// GetTimeout gets the LDAP connection timeout, defaulting to 10 seconds.
+func (lc LDAPConfig) GetTimeout() time.Duration {
+	if lc.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return lc.Timeout
+}
+
+// GetUserFilter gets the LDAP user search filter, defaulting to matching the uid attribute.
+func (lc LDAPConfig) GetUserFilter() string {
+	if len(lc.UserFilter) == 0 {
+		return "(uid=%s)"
+	}
+	return lc.UserFilter
+}
+
+// GetEmailAttribute gets the LDAP attribute that contains the email of users, defaulting to mail.
+func (lc LDAPConfig) GetEmailAttribute() string {
+	if len(lc.EmailAttribute) == 0 {
+		return "mail"
+	}
+	return lc.EmailAttribute
+}
+
+// GroupMapping maps the groups of an external identity provider to mauGFHS privileges.
+type GroupMapping struct {
+	// Members of these groups are admins. Admin status is only synced if groups are enabled and this
+	// list isn't empty.
+	AdminGroups []string `yaml:"adminGroups"`
+	// Namespace permissions granted to members of each group. They're removed when the user leaves
+	// the group.
+	GroupPermissions map[string]map[string]uint8 `yaml:"groupPermissions"`
+}
+
+// SignedURLConfig contains the settings for pre-signed file URLs.
+type SignedURLConfig struct {
+	// The secret key used to sign URLs. Signed URLs are disabled if the key is empty.
+	Key string `yaml:"key"`
+	// The maximum time a signed URL can be valid for.
+	MaxDuration time.Duration `yaml:"maxDuration"`
+}
+
+// FullTextConfig contains the settings for the full-text index of file contents.
+type FullTextConfig struct {
+	Enabled   bool `yaml:"enabled"`
+	MaxLength int  `yaml:"maxLength"`
+}
+
+// AdminConfig contains restrictions for admin privileges.
+type AdminConfig struct {
+	AllowedNetworks []string `yaml:"allowedNetworks"`
+}
+
+// IsAllowedAddress checks if admin privileges may be used from the given IP address. If no networks
+// are configured, admin privileges may be used from anywhere.
+func (ac AdminConfig) IsAllowedAddress(ip net.IP) bool {
+	if len(ac.AllowedNetworks) == 0 {
+		return true
+	}
+	return containsAddress(ac.AllowedNetworks, ip)
+}
+
+// containsAddress checks if the given IP address is in any of the given networks. Networks can be
+// in CIDR notation or single addresses.
+func containsAddress(networks []string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if !strings.ContainsRune(network, '/') {
+			if net.ParseIP(network).Equal(ip) {
+				return true
+			}
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(network)
+		if err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // LogConfig contains logging configurations
@@ -65,15 +351,23 @@ func (lc LogConfig) Configure(log *maulogger.Logger) {
 // ListenLocation is a location where the server should listen.
 type ListenLocation struct {
 	Address      string `yaml:"address"`
-	Port         uint8  `yaml:"port"`
+	Port         uint16 `yaml:"port"`
 	TrustHeaders bool   `yaml:"trustHeaders"`
-	PathPrefix   string `yaml:"pathPrefix"`
+	// The reverse proxies whose forwarding headers are trusted. If empty, only the proxy that
+	// connects to the server directly is trusted.
+	TrustedProxies []string `yaml:"trustedProxies"`
+	PathPrefix     string   `yaml:"pathPrefix"`
+}
+
+// IsTrustedProxy checks if the given address is a configured trusted proxy.
+func (ll ListenLocation) IsTrustedProxy(ip net.IP) bool {
+	return containsAddress(ll.TrustedProxies, ip)
 }
 
 // DBConfig contains connection information for the database.
 type DBConfig struct {
 	Host     string `yaml:"host"`
-	Port     uint8  `yaml:"port"`
+	Port     uint16 `yaml:"port"`
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
 	Database string `yaml:"database"`
@@ -0,0 +1,245 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	log "maunium.net/go/maulogger"
+)
+
+// APIKey is a key that authenticates requests as a user. The permissions of requests made with an
+// API key are limited to the scopes of the key.
+type APIKey struct {
+	ID         string        `json:"id"`
+	User       string        `json:"user"`
+	Name       string        `json:"name"`
+	Scopes     []APIKeyScope `json:"scopes"`
+	CreatedBy  string        `json:"createdBy"`
+	CreatedAt  time.Time     `json:"createdAt"`
+	ExpiresAt  *time.Time    `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time    `json:"lastUsedAt,omitempty"`
+}
+
+// APIKeyScope allows an API key to use the given permissions in a namespace and all namespaces
+// under it. Only PermissionRead and PermissionWrite can be used in scopes, so a scope can be
+// read-only, upload-only or both.
+type APIKeyScope struct {
+	Namespace  string          `json:"namespace"`
+	Permission PermissionValue `json:"permission"`
+}
+
+const apiKeysSchema = `
+	id         CHAR(16)     PRIMARY KEY,
+	user       VARCHAR(255) NOT NULL,
+	name       VARCHAR(255) NOT NULL,
+	hash       CHAR(64)     NOT NULL,
+	createdBy  VARCHAR(255) NOT NULL,
+	createdAt  BIGINT       NOT NULL,
+	expiresAt  BIGINT       NOT NULL DEFAULT 0,
+	lastUsedAt BIGINT       NOT NULL DEFAULT 0,
+	UNIQUE KEY (hash),
+	INDEX (user),
+	CONSTRAINT apikeys_user
+		FOREIGN KEY (user) REFERENCES users (email)
+		ON DELETE CASCADE
+		ON UPDATE RESTRICT
+`
+
+const apiKeyScopesSchema = `
+	apikey     CHAR(16)          NOT NULL,
+	namespace  VARCHAR(255)      NOT NULL,
+	permission SMALLINT UNSIGNED NOT NULL,
+	PRIMARY KEY (apikey, namespace),
+	CONSTRAINT apikeyscopes_apikey
+		FOREIGN KEY (apikey) REFERENCES apikeys (id)
+		ON DELETE CASCADE
+		ON UPDATE RESTRICT
+`
+
+const apiKeyColumns = "id,user,name,createdBy,createdAt,expiresAt,lastUsedAt"
+
+// ErrInvalidScope is returned when trying to create an API key with an invalid or empty scope.
+var ErrInvalidScope = errors.New("invalid API key scope")
+
+// CreateAPIKey generates an ID and a secret key for the given API key and inserts it into the
+// database. Only the hash of the secret key is stored, so the returned key can't be retrieved later.
+func CreateAPIKey(key *APIKey) (string, error) {
+	if err := ValidateScopes(key.Scopes, false); err != nil {
+		return "", err
+	}
+	key.ID = SecureRandomString(16)
+	key.CreatedAt = time.Now()
+	secret := SecureRandomString(48)
+	var expiresAt int64
+	if key.ExpiresAt != nil {
+		expiresAt = key.ExpiresAt.Unix()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("INSERT INTO apikeys (id,user,name,hash,createdBy,createdAt,expiresAt) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		key.ID, key.User, key.Name, hashToken(secret), key.CreatedBy, key.CreatedAt.Unix(), expiresAt)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	for _, scope := range key.Scopes {
+		_, err = tx.Exec("INSERT INTO apikeyscopes (apikey,namespace,permission) VALUES (?, ?, ?)",
+			key.ID, scope.Namespace, uint8(scope.Permission))
+		if err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+	return secret, tx.Commit()
+}
+
+// ValidateScopes checks that the given scopes only contain read and write permissions to valid
+// namespaces. Returns ErrInvalidScope if they don't, or if there are no scopes and allowEmpty is false.
+func ValidateScopes(scopes []APIKeyScope, allowEmpty bool) error {
+	if len(scopes) == 0 && !allowEmpty {
+		return ErrInvalidScope
+	}
+	for _, scope := range scopes {
+		if !IsValidNamespaceName(scope.Namespace) || scope.Permission == 0 || scope.Permission&^PermissionReadWrite != 0 {
+			return ErrInvalidScope
+		}
+	}
+	return nil
+}
+
+// GetAPIKey gets the API key with the given ID.
+func GetAPIKey(id string) *APIKey {
+	key, err := scanAPIKeyRow(db.QueryRow("SELECT "+apiKeyColumns+" FROM apikeys WHERE id=?", id))
+	if err != nil {
+		return nil
+	}
+	key.loadScopes()
+	return key
+}
+
+// GetAPIKeys gets all API keys of the user with the given email.
+func GetAPIKeys(email string) ([]*APIKey, error) {
+	results, err := db.Query("SELECT "+apiKeyColumns+" FROM apikeys WHERE user=? ORDER BY createdAt", email)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	keys := []*APIKey{}
+	for results.Next() {
+		key, err := scanAPIKeyRow(results)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err = results.Err(); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		key.loadScopes()
+	}
+	return keys, nil
+}
+
+// GetUserByAPIKey gets the user that owns the given secret API key. The returned user is limited to
+// the scopes of the key and never has admin privileges. Returns nil if the key is invalid or has
+// expired.
+func GetUserByAPIKey(secret string) *User {
+	key, err := scanAPIKeyRow(db.QueryRow("SELECT "+apiKeyColumns+" FROM apikeys WHERE hash=?", hashToken(secret)))
+	if err != nil || key.HasExpired() {
+		return nil
+	}
+	user := GetUser(key.User)
+	if user == nil {
+		return nil
+	}
+	key.loadScopes()
+	user.apiKey = key
+	user.Admin = false
+
+	now := time.Now()
+	key.LastUsedAt = &now
+	_, err = db.Exec("UPDATE apikeys SET lastUsedAt=? WHERE id=?", now.Unix(), key.ID)
+	if err != nil {
+		log.Warnf("Failed to update last use of API key %s: %v\n", key.ID, err)
+	}
+	return user
+}
+
+func scanAPIKeyRow(row scannable) (*APIKey, error) {
+	key := &APIKey{}
+	var createdAt, expiresAt, lastUsedAt int64
+	err := row.Scan(&key.ID, &key.User, &key.Name, &key.CreatedBy, &createdAt, &expiresAt, &lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	key.CreatedAt = time.Unix(createdAt, 0)
+	if expiresAt > 0 {
+		expiry := time.Unix(expiresAt, 0)
+		key.ExpiresAt = &expiry
+	}
+	if lastUsedAt > 0 {
+		lastUsed := time.Unix(lastUsedAt, 0)
+		key.LastUsedAt = &lastUsed
+	}
+	return key, nil
+}
+
+func (key *APIKey) loadScopes() {
+	key.Scopes = []APIKeyScope{}
+	results, err := db.Query("SELECT namespace,permission FROM apikeyscopes WHERE apikey=?", key.ID)
+	if err != nil {
+		return
+	}
+	defer results.Close()
+	for results.Next() {
+		var scope APIKeyScope
+		var permission uint8
+		if results.Scan(&scope.Namespace, &permission) == nil {
+			scope.Permission = PermissionValue(permission)
+			key.Scopes = append(key.Scopes, scope)
+		}
+	}
+}
+
+// HasExpired checks if this API key has expired.
+func (key *APIKey) HasExpired() bool {
+	return key.ExpiresAt != nil && !key.ExpiresAt.After(time.Now())
+}
+
+// GetPermissionTo gets the permissions this API key allows in the given namespace.
+func (key *APIKey) GetPermissionTo(namespace string) PermissionValue {
+	var pv PermissionValue
+	for _, scope := range key.Scopes {
+		if scope.Namespace == namespace || strings.HasPrefix(namespace, scope.Namespace+"/") {
+			pv |= scope.Permission
+		}
+	}
+	return pv
+}
+
+// Delete deletes this API key from the database.
+func (key *APIKey) Delete() error {
+	_, err := db.Exec("DELETE FROM apikeys WHERE id=?", key.ID)
+	return err
+}
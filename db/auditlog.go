@@ -0,0 +1,188 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "maunium.net/go/maulogger"
+)
+
+// AuditEvent is a security-relevant action recorded in the audit log.
+type AuditEvent struct {
+	ID        int64       `json:"id"`
+	Timestamp time.Time   `json:"timestamp"`
+	Action    AuditAction `json:"action"`
+	// The user who performed the action. Empty for anonymous actions, such as uploads through share
+	// links, and for actions done by the server itself.
+	Actor      string `json:"actor,omitempty"`
+	TargetType string `json:"targetType,omitempty"`
+	Target     string `json:"target,omitempty"`
+	IP         string `json:"ip,omitempty"`
+	Details    string `json:"details,omitempty"`
+}
+
+// AuditAction is the type of an audit event.
+type AuditAction string
+
+// The actions recorded in the audit log.
+const (
+	AuditLogin             AuditAction = "login"
+	AuditLoginFailed       AuditAction = "login.failed"
+	AuditTokenCreated      AuditAction = "token.created"
+	AuditTokenRevoked      AuditAction = "token.revoked"
+	AuditFileUploaded      AuditAction = "file.uploaded"
+	AuditFileOverwritten   AuditAction = "file.overwritten"
+	AuditFileMoved         AuditAction = "file.moved"
+	AuditFileCopied        AuditAction = "file.copied"
+	AuditFileDeleted       AuditAction = "file.deleted"
+	AuditNamespaceMoved    AuditAction = "namespace.moved"
+	AuditNamespaceDeleted  AuditAction = "namespace.deleted"
+	AuditPermissionChanged AuditAction = "permission.changed"
+	AuditTOTPEnabled       AuditAction = "totp.enabled"
+	AuditTOTPDisabled      AuditAction = "totp.disabled"
+	AuditLockoutCleared    AuditAction = "lockout.cleared"
+	AuditAdminOverride     AuditAction = "admin.override"
+)
+
+// Target types of audit events that aren't permission targets.
+const (
+	AuditTargetUser         = "user"
+	AuditTargetAPIKey       = "apikey"
+	AuditTargetShareLink    = "sharelink"
+	AuditTargetRefreshToken = "refreshtoken"
+	AuditTargetSignedURL    = "signedurl"
+)
+
+const auditLogSchema = `
+	id         BIGINT       PRIMARY KEY AUTO_INCREMENT,
+	timestamp  BIGINT       NOT NULL,
+	action     VARCHAR(32)  NOT NULL,
+	actor      VARCHAR(255) NOT NULL,
+	targetType VARCHAR(32)  NOT NULL,
+	target     VARCHAR(512) NOT NULL,
+	ip         VARCHAR(45)  NOT NULL,
+	details    TEXT         NOT NULL,
+	INDEX (timestamp),
+	INDEX (actor),
+	INDEX (action)
+`
+
+const auditEventColumns = "id,timestamp,action,actor,targetType,target,ip,details"
+
+// RecordAuditEvent inserts the given event into the audit log. The timestamp is set to the current
+// time. Failures are logged, as they shouldn't prevent the action from happening.
+func RecordAuditEvent(event *AuditEvent) {
+	event.Timestamp = time.Now()
+	result, err := db.Exec("INSERT INTO auditlog (timestamp,action,actor,targetType,target,ip,details) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		event.Timestamp.Unix(), string(event.Action), event.Actor, event.TargetType, event.Target, event.IP, event.Details)
+	if err != nil {
+		log.Errorf("Failed to record %s of %s %s by %s in audit log: %v\n", event.Action, event.TargetType, event.Target, event.Actor, err)
+		return
+	}
+	event.ID, _ = result.LastInsertId()
+}
+
+// AuditQuery contains filters for reading the audit log. Empty fields aren't used for filtering.
+type AuditQuery struct {
+	Actor      string
+	Action     AuditAction
+	TargetType string
+	// A target, or a namespace that the targets must be in or under.
+	Target string
+	IP     string
+	// The time range of the events. Both ends are inclusive.
+	After  time.Time
+	Before time.Time
+	// The maximum number of events to get, or zero for no limit.
+	Limit  int
+	Offset int
+}
+
+func (query AuditQuery) build() (string, []interface{}) {
+	conditions := []string{"1=1"}
+	args := []interface{}{}
+	addCondition := func(condition string, conditionArgs ...interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, conditionArgs...)
+	}
+	if len(query.Actor) > 0 {
+		addCondition("actor=?", query.Actor)
+	}
+	if len(query.Action) > 0 {
+		addCondition("action=?", string(query.Action))
+	}
+	if len(query.TargetType) > 0 {
+		addCondition("targetType=?", query.TargetType)
+	}
+	if len(query.Target) > 0 {
+		addCondition("(target=? OR target LIKE ?)", query.Target, escapeLike(query.Target)+"/%")
+	}
+	if len(query.IP) > 0 {
+		addCondition("ip=?", query.IP)
+	}
+	if !query.After.IsZero() {
+		addCondition("timestamp>=?", query.After.Unix())
+	}
+	if !query.Before.IsZero() {
+		addCondition("timestamp<=?", query.Before.Unix())
+	}
+	statement := fmt.Sprintf("SELECT %s FROM auditlog WHERE %s ORDER BY id", auditEventColumns, strings.Join(conditions, " AND "))
+	if query.Limit > 0 {
+		statement += " LIMIT ? OFFSET ?"
+		args = append(args, query.Limit, query.Offset)
+	}
+	return statement, args
+}
+
+// ScanAuditLog calls the given function with each audit event matching the query, oldest first.
+// Scanning stops if the function returns an error.
+func ScanAuditLog(query AuditQuery, fn func(*AuditEvent) error) error {
+	statement, args := query.build()
+	results, err := db.Query(statement, args...)
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	for results.Next() {
+		event := &AuditEvent{}
+		var timestamp int64
+		var action string
+		err = results.Scan(&event.ID, &timestamp, &action, &event.Actor, &event.TargetType, &event.Target, &event.IP, &event.Details)
+		if err != nil {
+			return err
+		}
+		event.Timestamp = time.Unix(timestamp, 0)
+		event.Action = AuditAction(action)
+		if err = fn(event); err != nil {
+			return err
+		}
+	}
+	return results.Err()
+}
+
+// GetAuditEvents gets the audit events matching the query, oldest first.
+func GetAuditEvents(query AuditQuery) ([]*AuditEvent, error) {
+	events := []*AuditEvent{}
+	err := ScanAuditLog(query, func(event *AuditEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	return events, err
+}
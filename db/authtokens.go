@@ -17,33 +17,89 @@
 package db
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"time"
+
+	log "maunium.net/go/maulogger"
 )
 
-// AuthToken represents either an authentication token or a password recovery token.
+// AuthToken represents either an authentication token or a password recovery token. Only the hash of
+// the token is stored.
 type AuthToken struct {
-	User   string
-	Token  string
-	Expiry int64
+	User       string
+	Hash       string
+	CreatedBy  string
+	Expiry     int64
+	IsRecovery bool
 }
 
 const authTokensSchema = `
 	user VARCHAR(255) NOT NULL,
-	token VARCHAR(64) NOT NULL,
+	hash CHAR(64) PRIMARY KEY,
 	createdBy VARCHAR(255) NOT NULL,
 	expiry BIGINT NOT NULL,
 	isRecovery BOOLEAN NOT NULL DEFAULT '0',
-	PRIMARY KEY (user, token),
-	CONSTRAINT user_email
+	INDEX (user),
+	CONSTRAINT authtokens_user
 		FOREIGN KEY (user) REFERENCES users (email)
 		ON DELETE CASCADE
 		ON UPDATE RESTRICT
 `
 
+const authTokenColumns = "user,hash,createdBy,expiry,isRecovery"
+
+// hashToken hashes a token for storing in the database. The tokens are long random strings, so a
+// plain SHA-256 hash is enough and allows looking up tokens by their hash.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// migrateAuthTokens replaces the raw tokens in an authtokens table created by an older version with
+// hashes of the tokens. Existing tokens stay valid. Each step can be safely repeated, so a migration
+// that was interrupted is finished on the next start.
+func migrateAuthTokens() {
+	if hasColumn("authtokens", "token") {
+		log.Infoln("Migrating auth tokens to hashed storage")
+		hashAuthTokens()
+	}
+	// The default is only needed while adding the column to existing rows.
+	if hasColumnDefault("authtokens", "hash") {
+		_, err := db.Exec("ALTER TABLE authtokens ALTER COLUMN hash DROP DEFAULT")
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// hashAuthTokens adds the hash column, fills it with the hashes of the raw tokens and replaces the
+// token column with it.
+func hashAuthTokens() {
+	if !hasColumn("authtokens", "hash") {
+		_, err := db.Exec("ALTER TABLE authtokens ADD COLUMN hash CHAR(64) NOT NULL DEFAULT ''")
+		if err != nil {
+			panic(err)
+		}
+	}
+	statements := []string{
+		"UPDATE authtokens SET hash=SHA2(token, 256) WHERE hash=''",
+		// The old primary key allowed the same token for different users, but hashes must be unique.
+		"DELETE a FROM authtokens a JOIN authtokens b ON a.hash=b.hash AND a.user>b.user",
+		"ALTER TABLE authtokens DROP PRIMARY KEY, DROP COLUMN token, ADD PRIMARY KEY (hash), ADD INDEX (user)",
+	}
+	for _, statement := range statements {
+		_, err := db.Exec(statement)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
 // Delete this auth token from the database.
 func (at AuthToken) Delete() {
-	db.Exec("DELETE FROM authtokens WHERE user=? AND token=?", at.User, at.Token)
+	db.Exec("DELETE FROM authtokens WHERE hash=?", at.Hash)
 }
 
 // HasExpired checks if the auth token has expired.
@@ -51,16 +107,26 @@ func (at AuthToken) HasExpired() bool {
 	return at.Expiry < time.Now().Unix()
 }
 
+func scanAuthTokenRow(row scannable) (*AuthToken, error) {
+	at := &AuthToken{}
+	err := row.Scan(&at.User, &at.Hash, &at.CreatedBy, &at.Expiry, &at.IsRecovery)
+	if err != nil {
+		return nil, err
+	}
+	return at, nil
+}
+
+func scanAuthToken(row *sql.Row) *AuthToken {
+	at, _ := scanAuthTokenRow(row)
+	return at
+}
+
 func scanAuthTokens(results *sql.Rows) []AuthToken {
 	data := []AuthToken{}
 	for results.Next() {
-		var email, token, createdBy string
-		var expiry int64
-		var isRecovery bool
-		results.Scan(&email, &token, &createdBy, &expiry, &isRecovery)
-		at := AuthToken{User: email, Token: token, Expiry: expiry}
-		if !at.HasExpired() {
-			data = append(data, at)
+		at, err := scanAuthTokenRow(results)
+		if err == nil && !at.HasExpired() {
+			data = append(data, *at)
 		}
 	}
 	return data
@@ -0,0 +1,47 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHashToken(t *testing.T) {
+	// The hashes must match the output of SHA2(token, 256) in MySQL, which the migration of old raw
+	// tokens uses.
+	tests := map[string]string{
+		"":    "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"abc": "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+	}
+	for token, hash := range tests {
+		if hashed := hashToken(token); hashed != hash {
+			t.Errorf("Expected hash of %q to be %s, got %s", token, hash, hashed)
+		}
+	}
+	if hashToken(SecureRandomString(64)) == hashToken(SecureRandomString(64)) {
+		t.Error("Different tokens have the same hash")
+	}
+}
+
+func TestAuthTokenExpiry(t *testing.T) {
+	if !(AuthToken{Expiry: time.Now().Add(-time.Second).Unix()}).HasExpired() {
+		t.Error("Token that expired a second ago hasn't expired")
+	} else if (AuthToken{Expiry: time.Now().Add(time.Hour).Unix()}).HasExpired() {
+		t.Error("Token that expires in an hour has expired")
+	}
+}
@@ -19,6 +19,7 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 
 	"maunium.net/go/mauGFHS/db/config"
 
@@ -47,6 +48,53 @@ func createTable(name, schema string) {
 	}
 }
 
+// hasColumn checks if the given table has a column with the given name.
+func hasColumn(table, column string) bool {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME=? AND COLUMN_NAME=?`, table, column).Scan(&count)
+	if err != nil {
+		panic(err)
+	}
+	return count > 0
+}
+
+// hasColumnDefault checks if the given column of the given table has a default value.
+func hasColumnDefault(table, column string) bool {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME=? AND COLUMN_NAME=? AND COLUMN_DEFAULT IS NOT NULL`,
+		table, column).Scan(&count)
+	if err != nil {
+		panic(err)
+	}
+	return count > 0
+}
+
+// addColumn adds a column to an existing table unless it already exists. CREATE TABLE IF NOT EXISTS
+// doesn't change existing tables, so columns added to a schema later must also be added with this.
+func addColumn(table, column, definition string) {
+	if hasColumn(table, column) {
+		return
+	}
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// escapeLike escapes the wildcard characters of LIKE patterns in the given string.
+func escapeLike(str string) string {
+	return likeEscaper.Replace(str)
+}
+
 // Close closes the database connection.
 func Close() error {
 	if db != nil {
@@ -63,9 +111,27 @@ func Close() error {
 // CreateTables creates all the tables that are needed.
 func CreateTables() {
 	createTable("users", usersSchema)
+	migrateUsers()
+	migrateAuthTokens()
 	createTable("authtokens", authTokensSchema)
 	createTable("namespaces", namespacesSchema)
+	migrateNamespaces()
 	createTable("files", filesSchema)
+	migrateFiles()
 	createTable("filepermissions", filePermissionsSchema)
+	createTable("filemetadata", fileMetadataSchema)
+	createTable("filetags", fileTagsSchema)
+	createTable("filecontents", fileContentsSchema)
 	createTable("nspermissions", nsPermissionsSchema)
+	migrateNamespacePermissions()
+	createTable("nsredirects", nsRedirectsSchema)
+	createTable("sharelinks", shareLinksSchema)
+	createTable("apikeys", apiKeysSchema)
+	createTable("apikeyscopes", apiKeyScopesSchema)
+	createTable("totp", totpSchema)
+	createTable("recoverycodes", recoveryCodesSchema)
+	createTable("refreshtokens", refreshTokensSchema)
+	createTable("signingkeys", signingKeysSchema)
+	createTable("usedsignedurls", usedSignedURLsSchema)
+	createTable("auditlog", auditLogSchema)
 }
@@ -0,0 +1,228 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	log "maunium.net/go/maulogger"
+)
+
+// PermissionSource is the kind of rule that a permission value originates from.
+type PermissionSource string
+
+// The possible values for PermissionSource.
+const (
+	SourceFileGrant       PermissionSource = "file-grant"
+	SourceNamespaceGrant  PermissionSource = "namespace-grant"
+	SourceParentNamespace PermissionSource = "parent-namespace-grant"
+	SourceDefault         PermissionSource = "default"
+	SourceAdmin           PermissionSource = "admin"
+	SourceAPIKeyScope     PermissionSource = "api-key-scope"
+)
+
+// PermissionRule is a single rule that was considered when resolving an effective permission.
+type PermissionRule struct {
+	Source     PermissionSource `json:"source"`
+	Target     string           `json:"target"`
+	Permission PermissionValue  `json:"permission"`
+	// Applied is false if the rule was shadowed by a more specific rule.
+	Applied bool `json:"applied"`
+}
+
+// EffectivePermission is the permission a user has to a file or namespace along with the rules
+// that produced it.
+type EffectivePermission struct {
+	User       string               `json:"user"`
+	Target     string               `json:"target"`
+	TargetType PermissionTargetType `json:"targetType"`
+	Permission PermissionValue      `json:"permission"`
+	Rules      []PermissionRule     `json:"rules"`
+	// AdminOverride is true if the user only has the permission because they are an admin.
+	AdminOverride bool `json:"adminOverride"`
+	// The permission the user would have without admin privileges.
+	withoutAdmin PermissionValue
+}
+
+// ResolveFilePermission resolves the permissions the given user has to the given file.
+//
+// The most specific explicit grant wins: a file grant overrides a grant to the namespace of the
+// file, which overrides grants to parent namespaces. The default permissions of the file are
+// always added on top, as authenticating should never reduce access. Admins always have full
+// access. If the user is nil, only the default permissions are used. If the user authenticated with
+// an API key, the permissions are limited to the scopes of the key.
+func ResolveFilePermission(user *User, file *File) *EffectivePermission {
+	ep := &EffectivePermission{
+		Target:     file.Path(),
+		TargetType: TypeFilePermission,
+		Rules:      []PermissionRule{},
+	}
+	if user != nil {
+		ep.User = user.Email
+		if perm := user.getFileGrant(file); perm != nil {
+			ep.addGrant(SourceFileGrant, file.Path(), perm.GetPermission())
+		}
+		ep.addNamespaceGrants(user, file.GetNamespace())
+	}
+	ep.addDefault(file.Path(), file.DefaultPermissions)
+	ep.addAdmin(user, file.Path())
+	ep.addScope(user, file.Namespace)
+	return ep
+}
+
+// ResolveNamespacePermission resolves the permissions the given user has to the given namespace.
+// The rules are the same as in ResolveFilePermission, except that there is no file grant.
+func ResolveNamespacePermission(user *User, ns *Namespace) *EffectivePermission {
+	ep := &EffectivePermission{
+		Target:     ns.Name,
+		TargetType: TypeNamespacePermission,
+		Rules:      []PermissionRule{},
+	}
+	if user != nil {
+		ep.User = user.Email
+		ep.addNamespaceGrants(user, ns)
+	}
+	ep.addDefault(ns.Name, ns.DefaultPermissions)
+	ep.addAdmin(user, ns.Name)
+	ep.addScope(user, ns.Name)
+	return ep
+}
+
+func (ep *EffectivePermission) hasGrant() bool {
+	for _, rule := range ep.Rules {
+		if rule.Applied && rule.Source != SourceDefault {
+			return true
+		}
+	}
+	return false
+}
+
+func (ep *EffectivePermission) addGrant(source PermissionSource, target string, pv PermissionValue) {
+	applied := !ep.hasGrant()
+	if applied {
+		ep.Permission |= pv
+	}
+	ep.Rules = append(ep.Rules, PermissionRule{Source: source, Target: target, Permission: pv, Applied: applied})
+}
+
+func (ep *EffectivePermission) addNamespaceGrants(user *User, ns *Namespace) {
+	source := SourceNamespaceGrant
+	for ; ns != nil; ns = ns.GetParent() {
+		if perm := user.getNamespaceGrant(ns); perm != nil {
+			ep.addGrant(source, ns.Name, perm.GetPermission())
+		}
+		source = SourceParentNamespace
+	}
+}
+
+func (ep *EffectivePermission) addDefault(target string, pv PermissionValue) {
+	ep.Permission |= pv
+	ep.Rules = append(ep.Rules, PermissionRule{Source: SourceDefault, Target: target, Permission: pv, Applied: true})
+}
+
+func (ep *EffectivePermission) addAdmin(user *User, target string) {
+	ep.withoutAdmin = ep.Permission
+	if user == nil || !user.Admin {
+		return
+	}
+	ep.AdminOverride = ep.Permission != PermissionAll
+	ep.Permission = PermissionAll
+	ep.Rules = append(ep.Rules, PermissionRule{Source: SourceAdmin, Target: target, Permission: PermissionAll, Applied: true})
+}
+
+// addScope limits the permission to the scopes of the API key the user authenticated with. The
+// default permissions are kept, as they're available without authentication anyway.
+func (ep *EffectivePermission) addScope(user *User, namespace string) {
+	if user == nil || user.apiKey == nil {
+		return
+	}
+	scope := user.apiKey.GetPermissionTo(namespace)
+	var defaults PermissionValue
+	for _, rule := range ep.Rules {
+		if rule.Source == SourceDefault {
+			defaults |= rule.Permission
+		}
+	}
+	ep.Permission = ep.Permission&scope | defaults
+	ep.withoutAdmin = ep.withoutAdmin&scope | defaults
+	ep.Rules = append(ep.Rules, PermissionRule{Source: SourceAPIKeyScope, Target: namespace, Permission: scope, Applied: true})
+}
+
+// check checks the effective permission with the given function. If the check only passes because
+// the user is an admin, the override is recorded for the audit log.
+func (ep *EffectivePermission) check(user *User, check func(PermissionValue) bool) bool {
+	if !check(ep.Permission) {
+		return false
+	} else if ep.AdminOverride && !check(ep.withoutAdmin) {
+		user.recordOverride(ep)
+	}
+	return true
+}
+
+// maxOverrideDetails is the maximum number of targets listed in the details of an override event.
+const maxOverrideDetails = 20
+
+// AdminOverrides collects the permission checks that an admin only passed because of their admin
+// privileges, so that all the overrides of a request are recorded as a single audit event.
+type AdminOverrides struct {
+	actor   string
+	ip      string
+	targets []*EffectivePermission
+	seen    map[string]bool
+}
+
+func (ao *AdminOverrides) add(user *User, ep *EffectivePermission) {
+	key := ep.TargetType.String() + ":" + ep.Target
+	if ao.seen[key] {
+		return
+	} else if ao.seen == nil {
+		ao.seen = make(map[string]bool)
+	}
+	ao.seen[key] = true
+	ao.actor = user.Email
+	ao.ip = user.clientIP
+	ao.targets = append(ao.targets, ep)
+}
+
+// Record records the collected overrides in the log and the audit log. The first target is used as
+// the target of the audit event and all targets are listed in the details.
+func (ao *AdminOverrides) Record() {
+	if len(ao.targets) == 0 {
+		return
+	}
+	targets := make([]string, 0, len(ao.targets))
+	for i, ep := range ao.targets {
+		if i == maxOverrideDetails {
+			targets = append(targets, fmt.Sprintf("and %d more", len(ao.targets)-i))
+			break
+		}
+		targets = append(targets, ep.TargetType.String()+" "+ep.Target)
+	}
+	details := strings.Join(targets, ", ")
+	log.Infof("Admin %s overrode permissions to %s\n", ao.actor, details)
+	RecordAuditEvent(&AuditEvent{
+		Action:     AuditAdminOverride,
+		Actor:      ao.actor,
+		TargetType: ao.targets[0].TargetType.String(),
+		Target:     ao.targets[0].Target,
+		IP:         ao.ip,
+		Details:    details,
+	})
+	ao.targets = nil
+	ao.seen = nil
+}
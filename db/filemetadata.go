@@ -0,0 +1,197 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"errors"
+)
+
+const fileMetadataSchema = `
+	file  CHAR(32)     NOT NULL,
+	mkey  VARCHAR(255) NOT NULL,
+	value TEXT         NOT NULL,
+	PRIMARY KEY (file, mkey),
+	CONSTRAINT filemetadata_file
+		FOREIGN KEY (file) REFERENCES files (id)
+		ON DELETE CASCADE
+		ON UPDATE RESTRICT
+`
+
+const fileTagsSchema = `
+	file CHAR(32)     NOT NULL,
+	tag  VARCHAR(255) NOT NULL,
+	PRIMARY KEY (file, tag),
+	INDEX (tag),
+	CONSTRAINT filetags_file
+		FOREIGN KEY (file) REFERENCES files (id)
+		ON DELETE CASCADE
+		ON UPDATE RESTRICT
+`
+
+// Limits for custom file metadata and tags.
+const (
+	MaxMetadataKeyLength   = 255
+	MaxMetadataValueLength = 65535
+	MaxTagLength           = 255
+	MaxMetadataEntries     = 100
+	MaxTags                = 100
+)
+
+// Errors returned when validating metadata and tags.
+var (
+	ErrInvalidMetadataKey   = errors.New("invalid metadata key")
+	ErrMetadataValueTooLong = errors.New("metadata value too long")
+	ErrTooManyMetadata      = errors.New("too many metadata entries")
+	ErrInvalidTag           = errors.New("invalid tag")
+	ErrTooManyTags          = errors.New("too many tags")
+)
+
+// GetMetadata gets the custom key-value metadata of this file.
+func (file *File) GetMetadata() map[string]string {
+	data := make(map[string]string)
+	results, err := db.Query("SELECT mkey,value FROM filemetadata WHERE file=?", file.ID)
+	if err != nil {
+		return data
+	}
+	for results.Next() {
+		var key, value string
+		results.Scan(&key, &value)
+		data[key] = value
+	}
+	return data
+}
+
+// ValidateMetadata checks that the given metadata changes are within the limits.
+func ValidateMetadata(changes map[string]*string) error {
+	if len(changes) > MaxMetadataEntries {
+		return ErrTooManyMetadata
+	}
+	for key, value := range changes {
+		if len(key) == 0 || len(key) > MaxMetadataKeyLength {
+			return ErrInvalidMetadataKey
+		} else if value != nil && len(*value) > MaxMetadataValueLength {
+			return ErrMetadataValueTooLong
+		}
+	}
+	return nil
+}
+
+// UpdateMetadata changes the custom metadata of this file. Keys with a nil value are removed and
+// other keys are added or replaced. Keys that aren't in the map are not changed.
+func (file *File) UpdateMetadata(changes map[string]*string) error {
+	if err := ValidateMetadata(changes); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for key, value := range changes {
+		if value == nil {
+			_, err = tx.Exec("DELETE FROM filemetadata WHERE file=? AND mkey=?", file.ID, key)
+		} else {
+			_, err = tx.Exec("REPLACE INTO filemetadata (file,mkey,value) VALUES (?, ?, ?)", file.ID, key, *value)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	var count int
+	err = tx.QueryRow("SELECT COUNT(*) FROM filemetadata WHERE file=?", file.ID).Scan(&count)
+	if err == nil && count > MaxMetadataEntries {
+		err = ErrTooManyMetadata
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetMetadata adds the given metadata to this file.
+func (file *File) SetMetadata(metadata map[string]string) error {
+	changes := make(map[string]*string, len(metadata))
+	for key, value := range metadata {
+		value := value
+		changes[key] = &value
+	}
+	return file.UpdateMetadata(changes)
+}
+
+// GetTags gets the tags of this file.
+func (file *File) GetTags() []string {
+	tags := []string{}
+	results, err := db.Query("SELECT tag FROM filetags WHERE file=? ORDER BY tag", file.ID)
+	if err != nil {
+		return tags
+	}
+	for results.Next() {
+		var tag string
+		results.Scan(&tag)
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// ValidateTags checks that the given tags are within the limits.
+func ValidateTags(tags []string) error {
+	if len(tags) > MaxTags {
+		return ErrTooManyTags
+	}
+	for _, tag := range tags {
+		if len(tag) == 0 || len(tag) > MaxTagLength {
+			return ErrInvalidTag
+		}
+	}
+	return nil
+}
+
+// SetTags replaces the tags of this file with the given tags.
+func (file *File) SetTags(tags []string) error {
+	if err := ValidateTags(tags); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM filetags WHERE file=?", file.ID)
+	for _, tag := range tags {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("INSERT IGNORE INTO filetags (file,tag) VALUES (?, ?)", file.ID, tag)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// IsInvalidMetadataError checks if the given error was caused by invalid metadata or tags rather than a
+// database failure.
+func IsInvalidMetadataError(err error) bool {
+	switch err {
+	case ErrInvalidMetadataKey, ErrMetadataValueTooLong, ErrTooManyMetadata, ErrInvalidTag, ErrTooManyTags:
+		return true
+	}
+	return false
+}
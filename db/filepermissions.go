@@ -28,11 +28,11 @@ const filePermissionsSchema = `
 	file CHAR(32) NOT NULL,
 	permission SMALLINT UNSIGNED NOT NULL,
 	PRIMARY KEY(user, file),
-	CONSTRAINT user_email
+	CONSTRAINT filepermissions_user
 		FOREIGN KEY (user) REFERENCES users (email)
 		ON DELETE CASCADE
 		ON UPDATE RESTRICT,
-	CONSTRAINT file_id
+	CONSTRAINT filepermissions_file
 		FOREIGN KEY (file) REFERENCES files (id)
 		ON DELETE CASCADE
 		ON UPDATE RESTRICT
@@ -61,7 +61,10 @@ func (perm *FilePermission) Update() {
 func scanFilePermission(row *sql.Row) Permission {
 	var user, file string
 	var permission uint8
-	row.Scan(&user, &file, &permission)
+	err := row.Scan(&user, &file, &permission)
+	if err != nil {
+		return nil
+	}
 	return &FilePermission{basePermission{User: user, Target: file, Permission: PermissionValue(permission)}}
 }
 
@@ -17,10 +17,18 @@
 package db
 
 import (
+	cryptorand "crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"os"
 	"path"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	log "maunium.net/go/maulogger"
@@ -28,12 +36,20 @@ import (
 
 // File represents a file ID to name link.
 type File struct {
-	ID                 string
-	Size               int
-	Name               string
-	Namespace          string
-	MIME               string
-	DefaultPermissions PermissionValue
+	ID                 string          `json:"id"`
+	Size               int             `json:"size"`
+	Name               string          `json:"name"`
+	Namespace          string          `json:"namespace"`
+	MIME               string          `json:"mime"`
+	DefaultPermissions PermissionValue `json:"defaultPermissions"`
+	Hash               string          `json:"hash"`
+	CreatedAt          time.Time       `json:"createdAt"`
+	UpdatedAt          time.Time       `json:"updatedAt"`
+	CreatedBy          string          `json:"createdBy"`
+	ModifiedBy         string          `json:"modifiedBy"`
+	ExpiresAt          *time.Time      `json:"expiresAt,omitempty"`
+	Downloads          int             `json:"downloads"`
+	MaxDownloads       int             `json:"maxDownloads,omitempty"`
 	namespace          *Namespace
 	permissions        []Permission
 }
@@ -45,17 +61,49 @@ const filesSchema = `
 	namespace          VARCHAR(255)      NOT NULL,
 	mime               VARCHAR(255)      NOT NULL,
 	defaultPermissions SMALLINT UNSIGNED NOT NULL,
+	hash               CHAR(64)          NOT NULL DEFAULT '',
+	createdAt          BIGINT            NOT NULL DEFAULT 0,
+	updatedAt          BIGINT            NOT NULL DEFAULT 0,
+	createdBy          VARCHAR(255)      NOT NULL DEFAULT '',
+	modifiedBy         VARCHAR(255)      NOT NULL DEFAULT '',
+	expiresAt          BIGINT            NOT NULL DEFAULT 0,
+	downloads          INTEGER           NOT NULL DEFAULT 0,
+	maxDownloads       INTEGER           NOT NULL DEFAULT 0,
+	INDEX (expiresAt),
 	UNIQUE KEY (name, namespace),
-	CONSTRAINT namespace_name
+	CONSTRAINT files_namespace
 		FOREIGN KEY (namespace) REFERENCES namespaces (name)
 		ON DELETE CASCADE
 		ON UPDATE RESTRICT
 `
 
+// migrateFiles adds the columns that were added to the files table after it was created.
+func migrateFiles() {
+	addColumn("files", "hash", "CHAR(64) NOT NULL DEFAULT ''")
+	addColumn("files", "createdAt", "BIGINT NOT NULL DEFAULT 0")
+	addColumn("files", "updatedAt", "BIGINT NOT NULL DEFAULT 0")
+	addColumn("files", "createdBy", "VARCHAR(255) NOT NULL DEFAULT ''")
+	addColumn("files", "modifiedBy", "VARCHAR(255) NOT NULL DEFAULT ''")
+	addColumn("files", "expiresAt", "BIGINT NOT NULL DEFAULT 0, ADD INDEX (expiresAt)")
+	addColumn("files", "downloads", "INTEGER NOT NULL DEFAULT 0")
+	addColumn("files", "maxDownloads", "INTEGER NOT NULL DEFAULT 0")
+}
+
+const (
+	letterBytes   = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	letterIdxBits = 6
+	letterIdxMask = 1<<letterIdxBits - 1
+	letterIdxMax  = 63 / letterIdxBits
+)
+
 var src = rand.NewSource(time.Now().UnixNano())
+var srcLock sync.Mutex
 
-func GenerateFileID() string {
-	b := make([]byte, 32)
+// RandomString generates a random alphanumeric string with the given length.
+func RandomString(n int) string {
+	srcLock.Lock()
+	defer srcLock.Unlock()
+	b := make([]byte, n)
 	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
 	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
 		if remain == 0 {
@@ -72,78 +120,558 @@ func GenerateFileID() string {
 	return string(b)
 }
 
+// SecureRandomString generates a random alphanumeric string with the given length using a
+// cryptographically secure random number generator.
+func SecureRandomString(n int) string {
+	b := make([]byte, n)
+	buf := make([]byte, n)
+	for i := 0; i < n; {
+		_, err := cryptorand.Read(buf)
+		if err != nil {
+			panic(err)
+		}
+		for _, r := range buf {
+			if idx := int(r & letterIdxMask); idx < len(letterBytes) && i < n {
+				b[i] = letterBytes[idx]
+				i++
+			}
+		}
+	}
+	return string(b)
+}
+
+// GenerateFileID generates a random storage ID for a file.
+func GenerateFileID() string {
+	return RandomString(32)
+}
+
+const fileColumns = "id,size,name,namespace,mime,defaultPermissions,hash,createdAt,updatedAt,createdBy,modifiedBy,expiresAt,downloads,maxDownloads"
+
 // GetFileByID gets a file by its storage ID.
 func GetFileByID(id string) *File {
-	row := db.QueryRow(`SELECT id,size,name,namespace,mime,defaultPermissions FROM files WHERE id=?`, id)
-	if row != nil {
-		return scanFile(row)
-	}
-	return nil
+	return scanFile(db.QueryRow("SELECT "+fileColumns+" FROM files WHERE id=?", id))
 }
 
 // GetFileByPath gets a file by its namespace and name.
 func GetFileByPath(namespace, name string) *File {
-	row := db.QueryRow(`SELECT id,size,name,namespace,mime,defaultPermissions FROM files WHERE namespace=? AND name=?`, namespace, name)
-	if row != nil {
-		return scanFile(row)
+	return scanFile(db.QueryRow("SELECT "+fileColumns+" FROM files WHERE namespace=? AND name=?", namespace, name))
+}
+
+func scanFileRow(row scannable) (*File, error) {
+	var id, name, namespace, mime, hash, createdBy, modifiedBy string
+	var size, downloads, maxDownloads int
+	var createdAt, updatedAt, expiresAt int64
+	var defaultPermissions uint8
+	err := row.Scan(&id, &size, &name, &namespace, &mime, &defaultPermissions, &hash, &createdAt, &updatedAt, &createdBy, &modifiedBy, &expiresAt, &downloads, &maxDownloads)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	file := &File{
+		ID:                 id,
+		Size:               size,
+		Name:               name,
+		Namespace:          namespace,
+		MIME:               mime,
+		DefaultPermissions: PermissionValue(defaultPermissions),
+		Hash:               hash,
+		CreatedAt:          time.Unix(createdAt, 0),
+		UpdatedAt:          time.Unix(updatedAt, 0),
+		CreatedBy:          createdBy,
+		ModifiedBy:         modifiedBy,
+		Downloads:          downloads,
+		MaxDownloads:       maxDownloads,
+	}
+	if expiresAt > 0 {
+		expiry := time.Unix(expiresAt, 0)
+		file.ExpiresAt = &expiry
+	}
+	return file, nil
 }
 
 func scanFile(row *sql.Row) *File {
-	var id, name, namespace, mime string
-	var size int
-	var defaultPermissions uint8
-	row.Scan(&id, &size, &name, &namespace, &mime, &defaultPermissions)
-	return &File{ID: id, Size: size, Name: name, Namespace: namespace, MIME: mime, DefaultPermissions: PermissionValue(defaultPermissions)}
+	file, _ := scanFileRow(row)
+	return file
+}
+
+func scanFiles(results *sql.Rows) []*File {
+	data := []*File{}
+	for results.Next() {
+		file, err := scanFileRow(results)
+		if err == nil {
+			data = append(data, file)
+		}
+	}
+	return data
+}
+
+// FileSortFields contains the fields that file listings can be sorted by.
+var FileSortFields = map[string]string{
+	"name":      "name",
+	"namespace": "namespace",
+	"size":      "size",
+	"mime":      "mime",
+	"created":   "createdAt",
+	"updated":   "updatedAt",
+}
+
+// FileQuery contains the filters and sorting options for listing files. Zero values mean that the
+// field isn't used for filtering. Expired files are never included.
+type FileQuery struct {
+	// The namespaces to list files from.
+	Namespaces []string
+	// A namespace to list files from including all namespaces under it.
+	Subtree string
+	// A prefix that the names of the files must start with.
+	Prefix string
+	// Glob patterns (with * and ?) that the names and MIME types of the files must match.
+	NamePattern string
+	MIMEPattern string
+	// The size range of the files in bytes. Both ends are inclusive.
+	MinSize int64
+	MaxSize int64
+	// The creation and modification time ranges of the files. Both ends are inclusive.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+	// Tags that the files must have.
+	Tags []string
+	// Metadata keys and values that the files must have.
+	Metadata map[string]string
+	// Text to search for in the full-text index.
+	Content string
+	// The field to sort by. Must be one of the keys in FileSortFields, or "relevance" if Content is set.
+	SortBy     string
+	Descending bool
+	// If FilterReadable is true, only files that Reader can read are included. A nil Reader is an
+	// anonymous user.
+	FilterReadable bool
+	Reader         *User
+	// The page of files to get. A zero limit means no limit.
+	Offset int
+	Limit  int
+}
+
+// globToLike converts a glob pattern into a LIKE pattern.
+func globToLike(pattern string) string {
+	return strings.NewReplacer("*", "%", "?", "_").Replace(escapeLike(pattern))
+}
+
+// availableCondition matches files that haven't expired or run out of downloads. The current unix
+// timestamp must be given as an argument.
+const availableCondition = "(expiresAt=0 OR expiresAt>?) AND (maxDownloads=0 OR downloads<maxDownloads)"
+
+// readableCondition gets an SQL condition that matches the files the given user can read. The rules
+// are the same as in ResolveFilePermission, but the namespace grants and API key scopes of the user
+// are only loaded once instead of once per file. If withAdmin is false, the condition matches the
+// files the user could read without admin privileges.
+func readableCondition(user *User, withAdmin bool) (string, []interface{}) {
+	readMask := uint8(PermissionRead | PermissionCreator)
+	if user == nil {
+		return fmt.Sprintf("defaultPermissions & %d <> 0", readMask), nil
+	}
+
+	var args []interface{}
+	grant := fmt.Sprint(uint8(PermissionAll))
+	if !withAdmin || !user.Admin {
+		args = append(args, user.Email)
+		grants := user.GetPermissionsToNamespaces()
+		// The nearest namespace grant wins, so check the longest names first.
+		sort.Slice(grants, func(i, j int) bool {
+			return len(grants[i].GetTarget()) > len(grants[j].GetTarget())
+		})
+		nsGrant := "0"
+		if len(grants) > 0 {
+			nsGrant = "CASE"
+			for _, grant := range grants {
+				nsGrant += fmt.Sprintf(" WHEN namespace=? OR namespace LIKE ? THEN %d", uint8(grant.GetPermission()))
+				args = append(args, grant.GetTarget(), escapeLike(grant.GetTarget())+"/%")
+			}
+			nsGrant += " ELSE 0 END"
+		}
+		grant = "COALESCE((SELECT permission FROM filepermissions WHERE filepermissions.file=files.id AND filepermissions.user=?), " + nsGrant + ")"
+	}
+	if user.apiKey != nil {
+		scope := "0"
+		for _, keyScope := range user.apiKey.Scopes {
+			scope += fmt.Sprintf(" | CASE WHEN namespace=? OR namespace LIKE ? THEN %d ELSE 0 END", uint8(keyScope.Permission))
+			args = append(args, keyScope.Namespace, escapeLike(keyScope.Namespace)+"/%")
+		}
+		grant = "(" + grant + ") & (" + scope + ")"
+	}
+	return fmt.Sprintf("(defaultPermissions | %s) & %d <> 0", grant, readMask), args
+}
+
+// conditions builds the FROM and WHERE parts of the query.
+func (query FileQuery) conditions() (string, string, []interface{}) {
+	table := "files"
+	conditions := []string{availableCondition}
+	args := []interface{}{time.Now().Unix()}
+	addCondition := func(condition string, conditionArgs ...interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, conditionArgs...)
+	}
+	if len(query.Namespaces) > 0 {
+		nsArgs := make([]interface{}, len(query.Namespaces))
+		for i, ns := range query.Namespaces {
+			nsArgs[i] = ns
+		}
+		addCondition("namespace IN ("+strings.Repeat(",?", len(query.Namespaces))[1:]+")", nsArgs...)
+	}
+	if len(query.Subtree) > 0 {
+		addCondition("(namespace=? OR namespace LIKE ?)", query.Subtree, escapeLike(query.Subtree)+"/%")
+	}
+	if len(query.Prefix) > 0 {
+		addCondition("name LIKE ?", escapeLike(query.Prefix)+"%")
+	}
+	if len(query.NamePattern) > 0 {
+		addCondition("name LIKE ?", globToLike(query.NamePattern))
+	}
+	if len(query.MIMEPattern) > 0 {
+		addCondition("mime LIKE ?", globToLike(query.MIMEPattern))
+	}
+	if query.MinSize > 0 {
+		addCondition("size>=?", query.MinSize)
+	}
+	if query.MaxSize > 0 {
+		addCondition("size<=?", query.MaxSize)
+	}
+	if !query.CreatedAfter.IsZero() {
+		addCondition("createdAt>=?", query.CreatedAfter.Unix())
+	}
+	if !query.CreatedBefore.IsZero() {
+		addCondition("createdAt<=?", query.CreatedBefore.Unix())
+	}
+	if !query.UpdatedAfter.IsZero() {
+		addCondition("updatedAt>=?", query.UpdatedAfter.Unix())
+	}
+	if !query.UpdatedBefore.IsZero() {
+		addCondition("updatedAt<=?", query.UpdatedBefore.Unix())
+	}
+	for _, tag := range query.Tags {
+		addCondition("EXISTS (SELECT 1 FROM filetags WHERE filetags.file=files.id AND filetags.tag=?)", tag)
+	}
+	for key, value := range query.Metadata {
+		addCondition("EXISTS (SELECT 1 FROM filemetadata WHERE filemetadata.file=files.id AND filemetadata.mkey=? AND filemetadata.value=?)", key, value)
+	}
+	if len(query.Content) > 0 {
+		table = "files JOIN filecontents ON filecontents.file=files.id"
+		addCondition("MATCH(filecontents.content) AGAINST(?)", query.Content)
+	}
+	if query.FilterReadable {
+		addCondition(readableCondition(query.Reader, true))
+	}
+	return table, strings.Join(conditions, " AND "), args
+}
+
+func (query FileQuery) build() (string, []interface{}, error) {
+	direction := "ASC"
+	if query.Descending {
+		direction = "DESC"
+	}
+	column, ok := FileSortFields[query.SortBy]
+	orderArgs := []interface{}{}
+	if !ok && query.SortBy == "relevance" && len(query.Content) > 0 {
+		column = "MATCH(filecontents.content) AGAINST(?)"
+		orderArgs = append(orderArgs, query.Content)
+		direction = "DESC"
+	} else if !ok {
+		return "", nil, fmt.Errorf("unknown sort field %s", query.SortBy)
+	}
+
+	table, where, args := query.conditions()
+	statement := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s %s, namespace, name",
+		fileColumns, table, where, column, direction)
+	args = append(args, orderArgs...)
+	if query.Limit > 0 {
+		statement += " LIMIT ? OFFSET ?"
+		args = append(args, query.Limit, query.Offset)
+	}
+	return statement, args, nil
+}
+
+// CountFiles counts the files matching the given query. The sorting and pagination fields are ignored.
+func CountFiles(query FileQuery) (int, error) {
+	table, where, args := query.conditions()
+	var count int
+	err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", table, where), args...).Scan(&count)
+	return count, err
+}
+
+// ListFiles gets all files matching the given query.
+func ListFiles(query FileQuery) ([]*File, error) {
+	statement, args, err := query.build()
+	if err != nil {
+		return nil, err
+	}
+	results, err := db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	files := scanFiles(results)
+	if query.FilterReadable && query.Reader != nil && query.Reader.Admin {
+		recordListOverrides(query.Reader, files)
+	}
+	return files, nil
+}
+
+// recordListOverrides records an admin override for each of the listed files that the given admin
+// could only read because of their admin privileges.
+func recordListOverrides(user *User, files []*File) {
+	if len(files) == 0 {
+		return
+	}
+	byID := make(map[string]*File, len(files))
+	args := make([]interface{}, 0, len(files))
+	for _, file := range files {
+		byID[file.ID] = file
+		args = append(args, file.ID)
+	}
+	condition, conditionArgs := readableCondition(user, false)
+	results, err := db.Query(fmt.Sprintf("SELECT id FROM files WHERE id IN (%s) AND NOT (%s)",
+		strings.Repeat(",?", len(args))[1:], condition), append(args, conditionArgs...)...)
+	if err != nil {
+		log.Warnf("Failed to check admin overrides of %s in file listing: %v\n", user.Email, err)
+		return
+	}
+	defer results.Close()
+	for results.Next() {
+		var id string
+		if results.Scan(&id) == nil && byID[id] != nil {
+			byID[id].HasPermission(user, PermissionValue.CanRead)
+		}
+	}
+}
+
+// SearchFiles gets the page of files matching the given query. The second return value tells
+// whether there are more matching files after the page.
+func SearchFiles(query FileQuery) ([]*File, bool, error) {
+	limit := query.Limit
+	query.Limit++
+	files, err := ListFiles(query)
+	if err != nil {
+		return nil, false, err
+	} else if len(files) > limit {
+		return files[:limit], true, nil
+	}
+	return files, false, nil
 }
 
 // Insert inserts this File into the database.
 func (file *File) Insert() error {
-	_, err := db.Exec(
-		"INSERT INTO files (id,size,name,namespace,mime,defaultPermissions) VALUES (?, ?, ?, ?, ?, ?)",
-		file.ID, file.Size, file.Name, file.Namespace, file.MIME, uint8(file.DefaultPermissions))
+	return file.insert(db)
+}
+
+func (file *File) insert(ex execer) error {
+	_, err := ex.Exec(
+		"INSERT INTO files ("+fileColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		file.ID, file.Size, file.Name, file.Namespace, file.MIME, uint8(file.DefaultPermissions), file.Hash,
+		file.CreatedAt.Unix(), file.UpdatedAt.Unix(), file.CreatedBy, file.ModifiedBy, file.expiryUnix(),
+		file.Downloads, file.MaxDownloads)
+	return err
+}
+
+func (file *File) expiryUnix() int64 {
+	if file.ExpiresAt == nil {
+		return 0
+	}
+	return file.ExpiresAt.Unix()
+}
+
+// HasExpired checks if this file has expired. Expired files are deleted by the reaper.
+func (file *File) HasExpired() bool {
+	return file.ExpiresAt != nil && !file.ExpiresAt.After(time.Now())
+}
+
+// SetExpiry sets the time when this file expires. A nil expiry means that the file never expires.
+func (file *File) SetExpiry(expiry *time.Time) error {
+	file.ExpiresAt = expiry
+	_, err := db.Exec("UPDATE files SET expiresAt=? WHERE id=?", file.expiryUnix(), file.ID)
 	return err
 }
 
+// HasRunOutOfDownloads checks if this file has been downloaded the maximum number of times.
+func (file *File) HasRunOutOfDownloads() bool {
+	return file.MaxDownloads > 0 && file.Downloads >= file.MaxDownloads
+}
+
+// IsGone checks if this file has expired or run out of downloads. Such files are no longer
+// accessible and will be deleted by the reaper if they're not deleted before that.
+func (file *File) IsGone() bool {
+	return file.HasExpired() || file.HasRunOutOfDownloads()
+}
+
+// SetMaxDownloads sets the maximum number of times this file can be downloaded. Zero removes the
+// limit. The download counter is not reset.
+func (file *File) SetMaxDownloads(maxDownloads int) error {
+	file.MaxDownloads = maxDownloads
+	_, err := db.Exec("UPDATE files SET maxDownloads=? WHERE id=?", file.MaxDownloads, file.ID)
+	return err
+}
+
+// CountDownload atomically increments the download counter of this file. If the file has already
+// run out of downloads, the counter is not incremented and false is returned.
+func (file *File) CountDownload() (bool, error) {
+	result, err := db.Exec("UPDATE files SET downloads=downloads+1 WHERE id=? AND (maxDownloads=0 OR downloads<maxDownloads)", file.ID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	} else if affected == 0 {
+		return false, nil
+	}
+	err = db.QueryRow("SELECT downloads FROM files WHERE id=?", file.ID).Scan(&file.Downloads)
+	return true, err
+}
+
 // SetDefaultPermissions sets the default permissions to this file.
 func (file *File) SetDefaultPermissions(defaultPermissions PermissionValue) {
 	file.DefaultPermissions = defaultPermissions
-	db.Exec("UPDATE files SET defaultPermissions=%s WHERE id=%s", uint8(file.DefaultPermissions), file.ID)
+	db.Exec("UPDATE files SET defaultPermissions=? WHERE id=?", uint8(file.DefaultPermissions), file.ID)
 }
 
-// Delete deletes this file in the database.
-func (file *File) Delete() {
-	db.Exec("DELETE FROM files WHERE id=%s", file.ID)
+// Delete deletes this file and its share links from the database and removes its data from the disk.
+func (file *File) Delete() error {
+	_, err := db.Exec("DELETE FROM files WHERE id=?", file.ID)
+	if err != nil {
+		return err
+	}
+	removeFileData(file.ID)
+	return deleteShareLinks(db, TypeFilePermission, file.ID)
 }
 
 // Rename changes the name of this File.
 func (file *File) Rename(name string) error {
-	_, err := db.Exec("UPDATE files SET name=%s WHERE id=%s", name, file.ID)
+	return file.MoveTo(file.Namespace, name, nil)
+}
+
+// Move moves this file into another namespace.
+func (file *File) Move(namespace string) error {
+	return file.MoveTo(namespace, file.Name, nil)
+}
+
+// MoveTo changes both the namespace and the name of this file. If replace is not nil, it's deleted
+// in the same transaction to make room for this file.
+func (file *File) MoveTo(namespace, name string, replace *File) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	if replace != nil {
+		err = deleteFileRow(tx, replace)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE files SET namespace=?,name=? WHERE id=?", namespace, name, file.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	if replace != nil {
+		removeFileData(replace.ID)
+	}
+	file.Namespace = namespace
 	file.Name = name
 	return nil
 }
 
-// Move moves this file into another namespace.
-func (file *File) Move(namespace string) error {
-	_, err := db.Exec("UPDATE files SET namespace=%s WHERE id=%s", namespace, file.ID)
+// CopyTo copies this file along with its data, tags and metadata into the given namespace with the
+// given name. The copy gets the permissions of the target namespace like any other new file, and
+// the given user is recorded as its creator. If replace is not nil, it's deleted in the same
+// transaction as the copy is inserted in.
+func (file *File) CopyTo(ns *Namespace, name string, user *User, replace *File) (*File, error) {
+	data, err := file.Read()
+	if err != nil {
+		return nil, err
+	}
+	copied := ns.newFile(name, user)
+	copied.setData(data, file.MIME, user)
+	err = ioutil.WriteFile(path.Join(dataPath, copied.ID), data, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err == nil {
+		err = copied.insertCopy(tx, ns, file, replace)
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}
 	if err != nil {
+		removeFileData(copied.ID)
+		return nil, err
+	}
+	if replace != nil {
+		removeFileData(replace.ID)
+	}
+	if err = copied.updateIndex(data); err != nil {
+		log.Warnf("Failed to update full-text index of %s: %v\n", copied.Path(), err)
+	}
+	return copied, nil
+}
+
+// insertCopy inserts this file as a copy of the given source file along with the permissions of
+// the given namespace and the tags and metadata of the source.
+func (file *File) insertCopy(tx *sql.Tx, ns *Namespace, source, replace *File) error {
+	if replace != nil {
+		if err := deleteFileRow(tx, replace); err != nil {
+			return err
+		}
+	}
+	if err := file.insert(tx); err != nil {
 		return err
 	}
-	file.Namespace = namespace
+	for _, perm := range ns.GetPermissions() {
+		_, err := tx.Exec("INSERT INTO filepermissions (user,file,permission) VALUES (?, ?, ?)", perm.GetUser(), file.ID, uint8(perm.GetPermission()))
+		if err != nil {
+			return err
+		}
+	}
+	for _, tag := range source.GetTags() {
+		_, err := tx.Exec("INSERT IGNORE INTO filetags (file,tag) VALUES (?, ?)", file.ID, tag)
+		if err != nil {
+			return err
+		}
+	}
+	for key, value := range source.GetMetadata() {
+		_, err := tx.Exec("INSERT INTO filemetadata (file,mkey,value) VALUES (?, ?, ?)", file.ID, key, value)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// GetPermissionsFor gets the permissions to this file for a certain user. If the user is nil, the
-// default permissions to the file will be returned.
-func (file *File) GetPermissionsFor(user *User) PermissionValue {
-	if user != nil {
-		return user.GetPermissionValueToFile(file)
+// deleteFileRow deletes the given file and its share links in the given transaction. The data of
+// the file must be removed after committing.
+func deleteFileRow(tx *sql.Tx, file *File) error {
+	_, err := tx.Exec("DELETE FROM files WHERE id=?", file.ID)
+	if err != nil {
+		return err
 	}
-	return file.DefaultPermissions
+	return deleteShareLinks(tx, TypeFilePermission, file.ID)
+}
+
+// GetPermissionsFor gets the effective permissions to this file for a certain user. If the user is
+// nil, the default permissions to the file will be returned.
+func (file *File) GetPermissionsFor(user *User) PermissionValue {
+	return ResolveFilePermission(user, file).Permission
+}
+
+// HasPermission checks the effective permissions of the given user to this file with the given
+// function, e.g. PermissionValue.CanRead. If the check only passes because the user is an admin, the
+// override is recorded in the audit log.
+func (file *File) HasPermission(user *User, check func(PermissionValue) bool) bool {
+	return ResolveFilePermission(user, file).check(user, check)
 }
 
 // GetPermissions returns the permissions to this file.
@@ -167,7 +695,6 @@ func (file *File) GetNamespace() *Namespace {
 			ns = &Namespace{
 				Name:               file.Namespace,
 				DefaultPermissions: file.DefaultPermissions,
-				MIMETypes:          []string{},
 			}
 		}
 		file.namespace = ns
@@ -178,20 +705,54 @@ func (file *File) GetNamespace() *Namespace {
 // Read reads the file from disk.
 func (file *File) Read() ([]byte, error) {
 	data, err := ioutil.ReadFile(path.Join(dataPath, file.ID))
-	if len(data) != file.Size {
-		log.Warnf("File %s/%s had an unexpected size on disk! Expected: %d, got: %d", file.Namespace, file.Name, file.Size, len(data))
+	if err == nil && len(data) != file.Size {
+		log.Warnf("File %s/%s had an unexpected size on disk! Expected: %d, got: %d\n", file.Namespace, file.Name, file.Size, len(data))
 		file.Size = len(data)
-		db.Exec("UPDATE files SET size=%s WHERE id=%s", file.Size, file.ID)
+		db.Exec("UPDATE files SET size=? WHERE id=?", file.Size, file.ID)
 	}
 	return data, err
 }
 
-// Write writes data for this file to the disk.
-func (file *File) Write(data []byte, mime string) error {
+// Open opens the data of this file for reading.
+func (file *File) Open() (*os.File, error) {
+	return os.Open(path.Join(dataPath, file.ID))
+}
+
+// Write writes data for this file to the disk and updates the full-text index if it's enabled. The
+// given user is recorded as the last modifier of the file. If the user is nil, the file is recorded
+// as modified anonymously.
+func (file *File) Write(data []byte, mime string, user *User) error {
+	file.setData(data, mime, user)
+	_, err := db.Exec("UPDATE files SET size=?,mime=?,hash=?,updatedAt=?,modifiedBy=? WHERE id=?",
+		file.Size, file.MIME, file.Hash, file.UpdatedAt.Unix(), file.ModifiedBy, file.ID)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(dataPath, file.ID), data, 0644)
+	if err != nil {
+		return err
+	}
+	if err = file.updateIndex(data); err != nil {
+		log.Warnf("Failed to update full-text index of %s: %v\n", file.Path(), err)
+	}
+	return nil
+}
+
+// setData updates the fields that describe the data of this file.
+func (file *File) setData(data []byte, mime string, user *User) {
 	file.Size = len(data)
 	file.MIME = mime
-	db.Exec("UPDATE files SET size=%s,mime=%s WHERE id=%s", file.Size, file.MIME, file.ID)
-	return ioutil.WriteFile(path.Join(dataPath, file.ID), data, 0644)
+	hash := sha256.Sum256(data)
+	file.Hash = hex.EncodeToString(hash[:])
+	file.UpdatedAt = time.Now()
+	file.ModifiedBy = userEmail(user)
+}
+
+func removeFileData(id string) {
+	err := os.Remove(path.Join(dataPath, id))
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove data of file %s: %v\n", id, err)
+	}
 }
 
 // Path gets the display path of the file.
@@ -0,0 +1,97 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const fileContentsSchema = `
+	file    CHAR(32)   PRIMARY KEY,
+	content MEDIUMTEXT NOT NULL,
+	FULLTEXT (content),
+	CONSTRAINT filecontents_file
+		FOREIGN KEY (file) REFERENCES files (id)
+		ON DELETE CASCADE
+		ON UPDATE RESTRICT
+`
+
+var fullTextEnabled = false
+var fullTextMaxLength = 1 << 20
+
+// EnableFullTextIndex enables indexing the text content of files when they're written. At most
+// maxLength bytes of text are indexed per file. If maxLength is not positive, the default of 1 MiB
+// is used.
+func EnableFullTextIndex(maxLength int) {
+	fullTextEnabled = true
+	if maxLength > 0 {
+		fullTextMaxLength = maxLength
+	}
+}
+
+// IsFullTextIndexEnabled checks if the full-text index is enabled.
+func IsFullTextIndexEnabled() bool {
+	return fullTextEnabled
+}
+
+var textMIMETypes = []string{
+	"text/*",
+	"application/json", "application/*+json",
+	"application/xml", "application/*+xml",
+	"application/javascript", "application/x-yaml",
+}
+
+var htmlTagRegex = regexp.MustCompile(`(?s)<script.*?</script>|<style.*?</style>|<[^>]*>`)
+
+// extractText extracts indexable text from file data of the given MIME type. The second return
+// value is false if the MIME type is not text-like.
+func extractText(mime string, data []byte) (string, bool) {
+	if index := strings.IndexRune(mime, ';'); index >= 0 {
+		mime = mime[:index]
+	}
+	mime = strings.ToLower(strings.TrimSpace(mime))
+	if !matchesAny(mime, textMIMETypes) {
+		return "", false
+	}
+	if len(data) > fullTextMaxLength {
+		data = data[:fullTextMaxLength]
+	}
+	text := string(data)
+	if !utf8.ValidString(text) {
+		text = strings.ToValidUTF8(text, "")
+	}
+	if mime == "text/html" {
+		text = htmlTagRegex.ReplaceAllString(text, " ")
+	}
+	return text, true
+}
+
+// updateIndex updates the full-text index entry of this file with the given data.
+func (file *File) updateIndex(data []byte) error {
+	if !fullTextEnabled {
+		return nil
+	}
+	text, ok := extractText(file.MIME, data)
+	if !ok {
+		_, err := db.Exec("DELETE FROM filecontents WHERE file=?", file.ID)
+		return err
+	}
+	_, err := db.Exec("REPLACE INTO filecontents (file,content) VALUES (?, ?)", file.ID, text)
+	return err
+}
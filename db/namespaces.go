@@ -18,58 +18,182 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"strings"
+	"time"
+)
+
+// Errors returned by Namespace.Move
+var (
+	ErrNamespaceExists   = errors.New("target namespace already exists")
+	ErrNoParent          = errors.New("parent of target namespace doesn't exist")
+	ErrMoveIntoSelf      = errors.New("can't move namespace inside itself")
+	ErrNamespaceNotFound = errors.New("namespace doesn't exist")
 )
 
 // Namespace contains the details of a namespace.
 type Namespace struct {
-	Name               string
-	DefaultPermissions PermissionValue
-	MIMETypes          []string
-	parent             *Namespace
-	children           []*Namespace
-	permissions        []Permission
+	Name               string          `json:"name"`
+	DefaultPermissions PermissionValue `json:"defaultPermissions"`
+	// The MIME type and file extension restrictions of the namespace. See nspolicy.go for details.
+	MIMETypes        []string `json:"mimeTypes"`
+	DeniedMIMETypes  []string `json:"deniedMimeTypes"`
+	Extensions       []string `json:"extensions"`
+	DeniedExtensions []string `json:"deniedExtensions"`
+	// The upload policy of the namespace. See nspolicy.go for details.
+	MaxFileSize    *int64  `json:"maxFileSize"`
+	NamePattern    *string `json:"namePattern"`
+	AllowOverwrite *bool   `json:"allowOverwrite"`
+	GenerateNames  *bool   `json:"generateNames"`
+	// The default and maximum time to live of new files in seconds.
+	DefaultTTL  *int64 `json:"defaultTTL"`
+	MaxTTL      *int64 `json:"maxTTL"`
+	parent      *Namespace
+	children    []*Namespace
+	permissions []Permission
 }
 
 const namespacesSchema = `
 	name               VARCHAR(255)      PRIMARY KEY,
 	defaultPermissions SMALLINT UNSIGNED NOT NULL,
-	mimes              TEXT              NOT NULL
+	mimes              TEXT,
+	deniedMimes        TEXT,
+	extensions         TEXT,
+	deniedExtensions   TEXT,
+	maxFileSize        BIGINT,
+	namePattern        VARCHAR(255),
+	allowOverwrite     BOOLEAN,
+	generateNames      BOOLEAN,
+	defaultTTL         BIGINT,
+	maxTTL             BIGINT
 `
 
-func scanNamespace(row *sql.Row) *Namespace {
-	var name, mimes string
+// migrateNamespaces adds the policy columns to namespace tables created before they existed.
+func migrateNamespaces() {
+	var nullable string
+	err := db.QueryRow(`SELECT IS_NULLABLE FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA=DATABASE() AND TABLE_NAME='namespaces' AND COLUMN_NAME='mimes'`).Scan(&nullable)
+	if err != nil {
+		panic(err)
+	} else if nullable == "NO" {
+		// Empty MIME type lists used to mean no restriction, which is now expressed with NULL.
+		_, err = db.Exec("ALTER TABLE namespaces MODIFY mimes TEXT")
+		if err == nil {
+			_, err = db.Exec("UPDATE namespaces SET mimes=NULL WHERE mimes=''")
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	addColumn("namespaces", "deniedMimes", "TEXT")
+	addColumn("namespaces", "extensions", "TEXT")
+	addColumn("namespaces", "deniedExtensions", "TEXT")
+	addColumn("namespaces", "maxFileSize", "BIGINT")
+	addColumn("namespaces", "namePattern", "VARCHAR(255)")
+	addColumn("namespaces", "allowOverwrite", "BOOLEAN")
+	addColumn("namespaces", "generateNames", "BOOLEAN")
+	addColumn("namespaces", "defaultTTL", "BIGINT")
+	addColumn("namespaces", "maxTTL", "BIGINT")
+}
+
+const namespaceColumns = "name,defaultPermissions,mimes,deniedMimes,extensions,deniedExtensions,maxFileSize,namePattern,allowOverwrite,generateNames,defaultTTL,maxTTL"
+
+var namespacePlaceholders = strings.Repeat(",?", strings.Count(namespaceColumns, ",")+1)[1:]
+
+type scannable interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanNamespaceRow(row scannable) (*Namespace, error) {
+	var name string
+	var mimes, deniedMimes, extensions, deniedExtensions, namePattern sql.NullString
+	var maxFileSize, defaultTTL, maxTTL sql.NullInt64
+	var allowOverwrite, generateNames sql.NullBool
 	var defaultPermissions uint8
-	row.Scan(&name, &defaultPermissions, &mimes)
-	return &Namespace{
+	err := row.Scan(&name, &defaultPermissions, &mimes, &deniedMimes, &extensions, &deniedExtensions,
+		&maxFileSize, &namePattern, &allowOverwrite, &generateNames, &defaultTTL, &maxTTL)
+	if err != nil {
+		return nil, err
+	}
+	ns := &Namespace{
 		Name:               name,
 		DefaultPermissions: PermissionValue(defaultPermissions),
-		MIMETypes:          strings.Split(mimes, ","),
+		MIMETypes:          splitList(mimes),
+		DeniedMIMETypes:    splitList(deniedMimes),
+		Extensions:         splitList(extensions),
+		DeniedExtensions:   splitList(deniedExtensions),
+	}
+	if maxFileSize.Valid {
+		ns.MaxFileSize = &maxFileSize.Int64
+	}
+	if namePattern.Valid {
+		ns.NamePattern = &namePattern.String
+	}
+	if allowOverwrite.Valid {
+		ns.AllowOverwrite = &allowOverwrite.Bool
+	}
+	if generateNames.Valid {
+		ns.GenerateNames = &generateNames.Bool
 	}
+	if defaultTTL.Valid {
+		ns.DefaultTTL = &defaultTTL.Int64
+	}
+	if maxTTL.Valid {
+		ns.MaxTTL = &maxTTL.Int64
+	}
+	return ns, nil
+}
+
+func scanNamespace(row *sql.Row) *Namespace {
+	ns, _ := scanNamespaceRow(row)
+	return ns
 }
 
 func scanNamespaces(results *sql.Rows) []*Namespace {
 	data := []*Namespace{}
 	for results.Next() {
-		var name, mimes string
-		var defaultPermissions uint8
-		results.Scan(&name, &defaultPermissions, &mimes)
-		data = append(data, &Namespace{
-			Name:               name,
-			DefaultPermissions: PermissionValue(defaultPermissions),
-			MIMETypes:          strings.Split(mimes, ","),
-		})
+		ns, err := scanNamespaceRow(results)
+		if err == nil {
+			data = append(data, ns)
+		}
 	}
 	return data
 }
 
+// splitList splits a comma-separated list from the database. NULL values are returned as nil.
+func splitList(list sql.NullString) []string {
+	if !list.Valid {
+		return nil
+	} else if len(list.String) == 0 {
+		return []string{}
+	}
+	return strings.Split(list.String, ",")
+}
+
+// joinList joins a list into a comma-separated string for the database. nil lists are stored as NULL.
+func joinList(list []string) sql.NullString {
+	if list == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: strings.Join(list, ","), Valid: true}
+}
+
+// IsValidNamespaceName checks if the given string can be used as the name of a namespace.
+func IsValidNamespaceName(name string) bool {
+	if len(name) == 0 || len(name) > 255 {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if len(part) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // GetNamespace gets the namespace with the given name from the database.
 func GetNamespace(name string) *Namespace {
-	row := db.QueryRow(`SELECT name,defaultPermissions,mimes FROM namespaces WHERE name=?`, name)
-	if row != nil {
-		return scanNamespace(row)
-	}
-	return nil
+	return scanNamespace(db.QueryRow("SELECT "+namespaceColumns+" FROM namespaces WHERE name=?", name))
 }
 
 // GetParent gets the parent of this namespace, or nil if this namespace doesn't have parent.
@@ -84,10 +208,10 @@ func (ns *Namespace) GetParent() *Namespace {
 	return ns.parent
 }
 
-// GetChildren gets the namespaces that are children of this namespace.
+// GetChildren gets the namespaces that are direct children of this namespace.
 func (ns *Namespace) GetChildren() []*Namespace {
 	if ns.children == nil {
-		results, err := db.Query(`SELECT name,defaultPermissions,mimes FROM namespaces WHERE name LIKE ?`, ns.Name+"/%")
+		results, err := db.Query("SELECT "+namespaceColumns+" FROM namespaces WHERE name LIKE ? AND name NOT LIKE ?", escapeLike(ns.Name)+"/%", escapeLike(ns.Name)+"/%/%")
 		if err != nil {
 			return nil
 		}
@@ -96,13 +220,173 @@ func (ns *Namespace) GetChildren() []*Namespace {
 	return ns.children
 }
 
-func (ns *Namespace) CreateFile(name string) *File {
-	file := &File{
-		Namespace:          ns.Name,
-		Name:               name,
-		DefaultPermissions: ns.DefaultPermissions,
+// GetDescendants gets all the namespaces under this namespace, deepest namespaces first.
+func (ns *Namespace) GetDescendants() []*Namespace {
+	results, err := db.Query("SELECT "+namespaceColumns+" FROM namespaces WHERE name LIKE ? ORDER BY LENGTH(name) DESC", escapeLike(ns.Name)+"/%")
+	if err != nil {
+		return nil
+	}
+	return scanNamespaces(results)
+}
+
+// HasFiles checks if there are any files directly in this namespace.
+func (ns *Namespace) HasFiles() bool {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM files WHERE namespace=?`, ns.Name).Scan(&count)
+	return count > 0
+}
+
+// GetNearestParent gets the closest existing parent of the namespace with the given name, or nil if
+// none of the parents exist.
+func GetNearestParent(name string) *Namespace {
+	parts := strings.Split(name, "/")
+	for i := len(parts) - 1; i > 0; i-- {
+		ns := GetNamespace(strings.Join(parts[:i], "/"))
+		if ns != nil {
+			return ns
+		}
+	}
+	return nil
+}
+
+// CreateNamespace inserts the given namespace along with any missing parent namespaces. The parent
+// namespaces will get the same default permissions and inherit all other settings. The given
+// creator will be granted full permissions to all created namespaces.
+func CreateNamespace(ns *Namespace, creator *User) error {
+	parts := strings.Split(ns.Name, "/")
+	missing := []string{}
+	for i := 1; i <= len(parts); i++ {
+		if parent := strings.Join(parts[:i], "/"); i == len(parts) || GetNamespace(parent) == nil {
+			missing = append(missing, parent)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, nsName := range missing {
+		insert := &Namespace{Name: nsName, DefaultPermissions: ns.DefaultPermissions}
+		if nsName == ns.Name {
+			insert = ns
+		}
+		_, err = tx.Exec("INSERT INTO namespaces ("+namespaceColumns+") VALUES ("+namespacePlaceholders+")", insert.insertArgs()...)
+		if err == nil && creator != nil {
+			_, err = tx.Exec("INSERT INTO nspermissions (user,namespace,permission) VALUES (?, ?, ?)", creator.Email, nsName, uint8(PermissionAll))
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Move renames this namespace and all namespaces under it. The files and permissions of the
+// namespaces are moved too. The parent of the new name must exist. If redirectFor is positive, the
+// old names will redirect to the new names for that duration.
+func (ns *Namespace) Move(newName string, redirectFor time.Duration) error {
+	if newName == ns.Name || strings.HasPrefix(newName, ns.Name+"/") {
+		return ErrMoveIntoSelf
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = moveNamespaceTree(tx, ns.Name, newName, redirectFor)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	ns.Name = newName
+	ns.parent = nil
+	ns.children = nil
+	ns.permissions = nil
+	return nil
+}
+
+// moveNamespaceTree moves a namespace and all namespaces under it. The rows are locked while
+// checking that the source and parent exist and the targets don't, so that concurrent moves and
+// creations can't interfere.
+func moveNamespaceTree(tx *sql.Tx, oldName, newName string, redirectFor time.Duration) error {
+	var count int
+	if index := strings.LastIndexByte(newName, '/'); index >= 0 {
+		err := tx.QueryRow("SELECT COUNT(*) FROM namespaces WHERE name=? FOR UPDATE", newName[:index]).Scan(&count)
+		if err != nil {
+			return err
+		} else if count == 0 {
+			return ErrNoParent
+		}
+	}
+	results, err := tx.Query("SELECT "+namespaceColumns+" FROM namespaces WHERE name=? OR name LIKE ? FOR UPDATE", oldName, escapeLike(oldName)+"/%")
+	if err != nil {
+		return err
+	}
+	subtree := scanNamespaces(results)
+	if len(subtree) == 0 {
+		return ErrNamespaceNotFound
+	}
+	for _, child := range subtree {
+		err = tx.QueryRow("SELECT COUNT(*) FROM namespaces WHERE name=? FOR UPDATE", newName+strings.TrimPrefix(child.Name, oldName)).Scan(&count)
+		if err != nil {
+			return err
+		} else if count > 0 {
+			return ErrNamespaceExists
+		}
+	}
+
+	for _, child := range subtree {
+		moved := *child
+		moved.Name = newName + strings.TrimPrefix(child.Name, oldName)
+		err = moveNamespace(tx, child.Name, &moved, redirectFor)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func moveNamespace(tx *sql.Tx, oldName string, moved *Namespace, redirectFor time.Duration) error {
+	_, err := tx.Exec("INSERT INTO namespaces ("+namespaceColumns+") VALUES ("+namespacePlaceholders+")", moved.insertArgs()...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE files SET namespace=? WHERE namespace=?", moved.Name, oldName)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE nspermissions SET namespace=? WHERE namespace=?", moved.Name, oldName)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE sharelinks SET target=? WHERE targetType=? AND target=?", moved.Name, int(TypeNamespacePermission), oldName)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE apikeyscopes SET namespace=? WHERE namespace=?", moved.Name, oldName)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM namespaces WHERE name=?", oldName)
+	if err != nil {
+		return err
+	}
+	return addNamespaceRedirect(tx, oldName, moved.Name, redirectFor)
+}
+
+// CreateFile creates a new empty file with the given name in this namespace. The permissions to the
+// namespace are copied to the file, the given user is recorded as the creator and the expiry is set
+// based on the default TTL of the namespace.
+func (ns *Namespace) CreateFile(name string, creator *User) (*File, error) {
+	file := ns.newFile(name, creator)
+	err := file.Insert()
+	if err != nil {
+		return nil, err
 	}
-	file.Insert()
 	for _, nspermission := range ns.GetPermissions() {
 		filepermission := &FilePermission{basePermission{
 			User:       nspermission.GetUser(),
@@ -112,22 +396,40 @@ func (ns *Namespace) CreateFile(name string) *File {
 		filepermission.Insert()
 		file.permissions = append(file.permissions, filepermission)
 	}
+	return file, nil
+}
+
+// newFile creates the struct of a new file in this namespace without inserting it.
+func (ns *Namespace) newFile(name string, creator *User) *File {
+	now := time.Now()
+	file := &File{
+		ID:                 GenerateFileID(),
+		Namespace:          ns.Name,
+		Name:               name,
+		DefaultPermissions: ns.DefaultPermissions,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+		CreatedBy:          userEmail(creator),
+		ModifiedBy:         userEmail(creator),
+	}
+	if ttl := ns.CapTTL(ns.GetDefaultTTL()); ttl > 0 {
+		expiry := now.Add(ttl)
+		file.ExpiresAt = &expiry
+	}
 	return file
 }
 
-// MIMETypesString turns the allowed MIME types array into a string.
-func (ns *Namespace) MIMETypesString() string {
-	return strings.Join(ns.MIMETypes, ",")
+// GetPermissionsFor gets the effective permissions to this namespace for a certain user. If the user
+// is nil, the default permissions to the namespace will be returned.
+func (ns *Namespace) GetPermissionsFor(user *User) PermissionValue {
+	return ResolveNamespacePermission(user, ns).Permission
 }
 
-// IsMIMEAllowed checks if the given MIME type is allowed in this namespace.
-func (ns *Namespace) IsMIMEAllowed(mime string) bool {
-	for _, allowedMIME := range ns.MIMETypes {
-		if allowedMIME == mime {
-			return true
-		}
-	}
-	return false
+// HasPermission checks the effective permissions of the given user to this namespace with the given
+// function, e.g. PermissionValue.CanWrite. If the check only passes because the user is an admin,
+// the override is recorded in the audit log.
+func (ns *Namespace) HasPermission(user *User, check func(PermissionValue) bool) bool {
+	return ResolveNamespacePermission(user, ns).check(user, check)
 }
 
 // GetPermissions returns the permissions to this namespace.
@@ -143,17 +445,115 @@ func (ns *Namespace) GetPermissions() []Permission {
 	return ns.permissions
 }
 
-// Delete deletes this namespace from the database.
-func (ns *Namespace) Delete() {
-	db.Exec("DELETE FROM namespaces WHERE name=?", ns.Name)
+// Delete deletes this namespace and the files in it from the database and removes the data of the
+// files from the disk. Child namespaces are not deleted.
+func (ns *Namespace) Delete() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	ids, err := deleteNamespace(tx, ns.Name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		removeFileData(id)
+	}
+	return nil
+}
+
+// DeleteRecursive deletes this namespace and all namespaces under it along with their files in a
+// single transaction. The names of the deleted namespaces are returned, deepest namespaces first.
+func (ns *Namespace) DeleteRecursive() ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	results, err := tx.Query("SELECT name FROM namespaces WHERE name=? OR name LIKE ? ORDER BY LENGTH(name) DESC FOR UPDATE", ns.Name, escapeLike(ns.Name)+"/%")
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	names := []string{}
+	for results.Next() {
+		var name string
+		results.Scan(&name)
+		names = append(names, name)
+	}
+	results.Close()
+
+	ids := []string{}
+	for _, name := range names {
+		nsIDs, err := deleteNamespace(tx, name)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		ids = append(ids, nsIDs...)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		removeFileData(id)
+	}
+	return names, nil
+}
+
+// deleteNamespace deletes the namespace with the given name along with its files and share links.
+// The IDs of the deleted files are returned so that their data can be removed after committing.
+func deleteNamespace(tx *sql.Tx, name string) ([]string, error) {
+	results, err := tx.Query("SELECT id FROM files WHERE namespace=?", name)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for results.Next() {
+		var id string
+		results.Scan(&id)
+		ids = append(ids, id)
+	}
+	results.Close()
+
+	_, err = tx.Exec("DELETE FROM namespaces WHERE name=?", name)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		err = deleteShareLinks(tx, TypeFilePermission, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, deleteShareLinks(tx, TypeNamespacePermission, name)
 }
 
 // Update updates the database row for this namespace.
-func (ns *Namespace) Update() {
-	db.Exec("UPDATE namespaces SET mimetypes=? WHERE name=?", ns.MIMETypesString())
+func (ns *Namespace) Update() error {
+	_, err := db.Exec(`UPDATE namespaces
+		SET defaultPermissions=?,mimes=?,deniedMimes=?,extensions=?,deniedExtensions=?,
+			maxFileSize=?,namePattern=?,allowOverwrite=?,generateNames=?,defaultTTL=?,maxTTL=?
+		WHERE name=?`, append(ns.insertArgs()[1:], ns.Name)...)
+	return err
 }
 
 // Insert inserts this namespace definition into the database.
-func (ns *Namespace) Insert() {
-	db.Exec("INSERT INTO namespaces (name, defaultPermissions, mimetypes) VALUES (?, ?, ?)", ns.Name, ns.DefaultPermissions, ns.MIMETypesString())
+func (ns *Namespace) Insert() error {
+	_, err := db.Exec("INSERT INTO namespaces ("+namespaceColumns+") VALUES ("+namespacePlaceholders+")", ns.insertArgs()...)
+	return err
+}
+
+func (ns *Namespace) insertArgs() []interface{} {
+	return []interface{}{
+		ns.Name, uint8(ns.DefaultPermissions),
+		joinList(ns.MIMETypes), joinList(ns.DeniedMIMETypes),
+		joinList(ns.Extensions), joinList(ns.DeniedExtensions),
+		ns.MaxFileSize, ns.NamePattern, ns.AllowOverwrite, ns.GenerateNames, ns.DefaultTTL, ns.MaxTTL,
+	}
 }
@@ -27,17 +27,24 @@ const nsPermissionsSchema = `
 	user VARCHAR(255) NOT NULL,
 	namespace VARCHAR(255) NOT NULL,
 	permission SMALLINT UNSIGNED NOT NULL,
-	PRIMARY KEY(user, file),
-	CONSTRAINT user_email
+	source VARCHAR(32) NOT NULL DEFAULT '',
+	PRIMARY KEY(user, namespace),
+	CONSTRAINT nspermissions_user
 		FOREIGN KEY (user) REFERENCES users (email)
 		ON DELETE CASCADE
 		ON UPDATE RESTRICT,
-	CONSTRAINT namespace_name
+	CONSTRAINT nspermissions_namespace
 		FOREIGN KEY (namespace) REFERENCES namespaces (name)
 		ON DELETE CASCADE
 		ON UPDATE RESTRICT
 `
 
+// migrateNamespacePermissions adds the source column to namespace permissions. Grants made before
+// the column existed are treated as manual grants.
+func migrateNamespacePermissions() {
+	addColumn("nspermissions", "source", "VARCHAR(32) NOT NULL DEFAULT ''")
+}
+
 // GetTargetType gets the type of this permissions target object.
 func (perm *NamespacePermission) GetTargetType() PermissionTargetType {
 	return TypeNamespacePermission
@@ -53,15 +60,19 @@ func (perm *NamespacePermission) Insert() {
 	perm.basePermission.Insert("nspermissions", "namespace")
 }
 
-// Update updates the permission value of this entry in the database.
+// Update updates the permission value of this entry in the database. Updated entries become manual
+// grants, so group syncing won't change them anymore.
 func (perm *NamespacePermission) Update() {
-	perm.basePermission.Update("nspermissions", "namespace")
+	db.Exec("UPDATE nspermissions SET permission=?, source='' WHERE user=? AND namespace=?", perm.Permission, perm.User, perm.Target)
 }
 
 func scanNamespacePermission(row *sql.Row) Permission {
 	var user, namespace string
 	var permission uint8
-	row.Scan(&user, &namespace, &permission)
+	err := row.Scan(&user, &namespace, &permission)
+	if err != nil {
+		return nil
+	}
 	return &NamespacePermission{basePermission{User: user, Target: namespace, Permission: PermissionValue(permission)}}
 }
 
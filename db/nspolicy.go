@@ -0,0 +1,217 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"math"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	log "maunium.net/go/maulogger"
+)
+
+// Namespaces can restrict the MIME types and file name extensions of the files in them.
+//
+// Each restriction is a list of glob-style patterns (e.g. "image/*" or "*/*" for MIME types and
+// "png" or "*" for extensions). A file is accepted if it matches at least one pattern of the allow
+// list and no pattern of the deny list. An empty allow list or the pattern "*" allows anything.
+//
+// Lists that are not set (nil) are inherited from the parent namespace. If no namespace in the
+// chain sets a list, there is no restriction.
+
+// GetMIMETypes gets the effective allowed MIME type patterns of this namespace.
+func (ns *Namespace) GetMIMETypes() []string {
+	return ns.inheritList(func(ns *Namespace) []string { return ns.MIMETypes })
+}
+
+// GetDeniedMIMETypes gets the effective denied MIME type patterns of this namespace.
+func (ns *Namespace) GetDeniedMIMETypes() []string {
+	return ns.inheritList(func(ns *Namespace) []string { return ns.DeniedMIMETypes })
+}
+
+// GetExtensions gets the effective allowed file extension patterns of this namespace.
+func (ns *Namespace) GetExtensions() []string {
+	return ns.inheritList(func(ns *Namespace) []string { return ns.Extensions })
+}
+
+// GetDeniedExtensions gets the effective denied file extension patterns of this namespace.
+func (ns *Namespace) GetDeniedExtensions() []string {
+	return ns.inheritList(func(ns *Namespace) []string { return ns.DeniedExtensions })
+}
+
+func (ns *Namespace) inheritList(get func(ns *Namespace) []string) []string {
+	for ; ns != nil; ns = ns.GetParent() {
+		if list := get(ns); list != nil {
+			return list
+		}
+	}
+	return nil
+}
+
+// IsMIMEAllowed checks if the given MIME type is allowed in this namespace. MIME type parameters
+// such as the charset are ignored.
+func (ns *Namespace) IsMIMEAllowed(mime string) bool {
+	if index := strings.IndexRune(mime, ';'); index >= 0 {
+		mime = mime[:index]
+	}
+	mime = strings.ToLower(strings.TrimSpace(mime))
+	return isAllowed(mime, ns.GetMIMETypes(), ns.GetDeniedMIMETypes())
+}
+
+// IsExtensionAllowed checks if the extension of the given file name is allowed in this namespace.
+func (ns *Namespace) IsExtensionAllowed(name string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	return isAllowed(ext, ns.GetExtensions(), ns.GetDeniedExtensions())
+}
+
+func isAllowed(value string, allow, deny []string) bool {
+	return (len(allow) == 0 || matchesAny(value, allow)) && !matchesAny(value, deny)
+}
+
+func matchesAny(value string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(pattern), "."))
+		if pattern == "*" || pattern == value {
+			return true
+		} else if match, _ := path.Match(pattern, value); match {
+			return true
+		}
+	}
+	return false
+}
+
+// The upload policy of a namespace consists of a maximum file size, a regular expression that the
+// names of new files must fully match, whether or not existing files can be overwritten, whether or
+// not the server should generate the names of new files and the default time to live of new files.
+// Like the MIME type and extension restrictions, unset values are inherited from the parent
+// namespace.
+
+// GetMaxFileSize gets the effective maximum file size in this namespace. Zero means unlimited.
+func (ns *Namespace) GetMaxFileSize() int64 {
+	for ; ns != nil; ns = ns.GetParent() {
+		if ns.MaxFileSize != nil {
+			return *ns.MaxFileSize
+		}
+	}
+	return 0
+}
+
+// GetNamePattern gets the effective file name regex of this namespace.
+func (ns *Namespace) GetNamePattern() string {
+	for ; ns != nil; ns = ns.GetParent() {
+		if ns.NamePattern != nil {
+			return *ns.NamePattern
+		}
+	}
+	return ""
+}
+
+// CanOverwrite checks if existing files in this namespace can be overwritten. Defaults to true.
+func (ns *Namespace) CanOverwrite() bool {
+	for ; ns != nil; ns = ns.GetParent() {
+		if ns.AllowOverwrite != nil {
+			return *ns.AllowOverwrite
+		}
+	}
+	return true
+}
+
+// ShouldGenerateNames checks if the names of new files in this namespace are generated by the server.
+// Defaults to false.
+func (ns *Namespace) ShouldGenerateNames() bool {
+	for ; ns != nil; ns = ns.GetParent() {
+		if ns.GenerateNames != nil {
+			return *ns.GenerateNames
+		}
+	}
+	return false
+}
+
+// GetDefaultTTL gets the effective default time to live of new files in this namespace. Zero means
+// that files don't expire by default.
+func (ns *Namespace) GetDefaultTTL() time.Duration {
+	for ; ns != nil; ns = ns.GetParent() {
+		if ns.DefaultTTL != nil {
+			return SecondsToDuration(*ns.DefaultTTL)
+		}
+	}
+	return 0
+}
+
+// GetMaxTTL gets the effective maximum time to live of files in this namespace. Zero means that
+// there is no maximum.
+func (ns *Namespace) GetMaxTTL() time.Duration {
+	for ; ns != nil; ns = ns.GetParent() {
+		if ns.MaxTTL != nil {
+			return SecondsToDuration(*ns.MaxTTL)
+		}
+	}
+	return 0
+}
+
+// CapTTL limits the given time to live to the maximum of this namespace. Zero means that the file
+// never expires, so it's replaced with the maximum too.
+func (ns *Namespace) CapTTL(ttl time.Duration) time.Duration {
+	if maxTTL := ns.GetMaxTTL(); maxTTL > 0 && (ttl <= 0 || ttl > maxTTL) {
+		return maxTTL
+	}
+	return ttl
+}
+
+// SecondsToDuration converts the given number of seconds into a duration, clamping values that
+// don't fit in a duration.
+func SecondsToDuration(seconds int64) time.Duration {
+	if seconds > int64(math.MaxInt64/time.Second) {
+		return math.MaxInt64
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// IsNameAllowed checks if a new file with the given name can be created in this namespace.
+func (ns *Namespace) IsNameAllowed(name string) bool {
+	if !ns.IsExtensionAllowed(name) {
+		return false
+	}
+	pattern := ns.GetNamePattern()
+	if len(pattern) == 0 {
+		return true
+	}
+	regex, err := compileNamePattern(pattern)
+	if err != nil {
+		log.Warnf("Invalid file name pattern in namespace %s: %v\n", ns.Name, err)
+		return false
+	}
+	return regex.MatchString(name)
+}
+
+// ValidateNamePattern checks if the given file name pattern is a valid regular expression.
+func ValidateNamePattern(pattern string) error {
+	_, err := compileNamePattern(pattern)
+	return err
+}
+
+func compileNamePattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// GenerateFileName generates a random name for a new file in this namespace. The extension of the
+// given original name is preserved.
+func (ns *Namespace) GenerateFileName(originalName string) string {
+	return RandomString(16) + strings.ToLower(path.Ext(originalName))
+}
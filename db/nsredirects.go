@@ -0,0 +1,48 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+const nsRedirectsSchema = `
+	name   VARCHAR(255) PRIMARY KEY,
+	target VARCHAR(255) NOT NULL,
+	expiry BIGINT       NOT NULL
+`
+
+// GetNamespaceRedirect gets the new name of a namespace that was renamed, or an empty string if the
+// namespace hasn't been renamed or the redirect has expired.
+func GetNamespaceRedirect(name string) string {
+	var target string
+	err := db.QueryRow("SELECT target FROM nsredirects WHERE name=? AND expiry>=?", name, time.Now().Unix()).Scan(&target)
+	if err != nil {
+		return ""
+	}
+	return target
+}
+
+func addNamespaceRedirect(tx *sql.Tx, name, target string, redirectFor time.Duration) error {
+	_, err := tx.Exec("DELETE FROM nsredirects WHERE name=? OR expiry<?", target, time.Now().Unix())
+	if err != nil || redirectFor <= 0 {
+		return err
+	}
+	_, err = tx.Exec("REPLACE INTO nsredirects (name,target,expiry) VALUES (?, ?, ?)", name, target, time.Now().Add(redirectFor).Unix())
+	return err
+}
@@ -27,6 +27,22 @@ const (
 	TypeNamespacePermission
 )
 
+// String returns the name of this target type.
+func (ptt PermissionTargetType) String() string {
+	switch ptt {
+	case TypeFilePermission:
+		return "file"
+	case TypeNamespacePermission:
+		return "namespace"
+	}
+	return fmt.Sprintf("PermissionTargetType(%d)", int(ptt))
+}
+
+// MarshalText returns the name of this target type.
+func (ptt PermissionTargetType) MarshalText() ([]byte, error) {
+	return []byte(ptt.String()), nil
+}
+
 // PermissionValue is a int to permission enum mapping
 type PermissionValue uint8
 
@@ -37,21 +53,29 @@ const (
 	PermissionWrite     PermissionValue = 2
 	PermissionReadWrite PermissionValue = PermissionRead + PermissionWrite
 	PermissionCreator   PermissionValue = 4
+	PermissionCreateSub PermissionValue = 8
+	PermissionAll       PermissionValue = PermissionReadWrite + PermissionCreator + PermissionCreateSub
 )
 
 // CanRead checks if this PermissionValue is sufficient for reading files.
 func (pv PermissionValue) CanRead() bool {
-	return pv&PermissionRead == 1 || pv.IsCreator()
+	return pv&PermissionRead != 0 || pv.IsCreator()
 }
 
 // CanWrite checks if this PermissionValue is sufficient for writing files.
 func (pv PermissionValue) CanWrite() bool {
-	return pv&PermissionWrite == 1 || pv.IsCreator()
+	return pv&PermissionWrite != 0 || pv.IsCreator()
+}
+
+// CanCreateSubnamespaces checks if this PermissionValue is sufficient for creating namespaces under
+// the target namespace.
+func (pv PermissionValue) CanCreateSubnamespaces() bool {
+	return pv&PermissionCreateSub != 0 || pv.IsCreator()
 }
 
 // IsCreator checks if this PermissionValue is for the creator of the target.
 func (pv PermissionValue) IsCreator() bool {
-	return pv&PermissionCreator == 1
+	return pv&PermissionCreator != 0
 }
 
 // Permission is an abstract permission.
@@ -117,10 +141,10 @@ func (perm *basePermission) Delete(tableName, targetFieldName string) {
 
 // Insert inserts this permission entry into the database.
 func (perm *basePermission) Insert(tableName, targetFieldName string) {
-	db.Exec(fmt.Sprintf("INSERT INTO %s (user, %s, permissions) VALUES (?, ?, ?)", tableName, targetFieldName), perm.User, perm.Target, perm.Permission)
+	db.Exec(fmt.Sprintf("INSERT INTO %s (user, %s, permission) VALUES (?, ?, ?)", tableName, targetFieldName), perm.User, perm.Target, perm.Permission)
 }
 
 // Update updates the permission value of this entry in the database.
 func (perm *basePermission) Update(tableName, targetFieldName string) {
-	db.Exec(fmt.Sprintf("UPDATE %s SET permissions=? WHERE user=? AND %s=?", tableName, targetFieldName), perm.Permission, perm.User, perm.Target)
+	db.Exec(fmt.Sprintf("UPDATE %s SET permission=? WHERE user=? AND %s=?", tableName, targetFieldName), perm.Permission, perm.User, perm.Target)
 }
@@ -0,0 +1,70 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"time"
+
+	log "maunium.net/go/maulogger"
+)
+
+// DeleteExpiredFiles deletes all files that have expired or run out of downloads from the database
+// and removes their data from the disk. Returns the number of deleted files.
+func DeleteExpiredFiles() (int, error) {
+	results, err := db.Query("SELECT "+fileColumns+" FROM files WHERE NOT ("+availableCondition+")", time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	files := scanFiles(results)
+	deleted := 0
+	for _, file := range files {
+		err = file.Delete()
+		if err != nil {
+			log.Warnf("Failed to delete expired file %s: %v\n", file.Path(), err)
+			continue
+		}
+		RecordAuditEvent(&AuditEvent{
+			Action:     AuditFileDeleted,
+			TargetType: TypeFilePermission.String(),
+			Target:     file.Path(),
+			Details:    "expired or out of downloads",
+		})
+		deleted++
+	}
+	return deleted, nil
+}
+
+// StartReaper starts a goroutine that deletes expired files, refresh tokens and used signed URLs at
+// the given interval.
+func StartReaper(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			deleted, err := DeleteExpiredFiles()
+			if err != nil {
+				log.Errorln("Failed to delete expired files:", err)
+			} else if deleted > 0 {
+				log.Debugf("Deleted %d expired files\n", deleted)
+			}
+			if err = DeleteExpiredRefreshTokens(); err != nil {
+				log.Errorln("Failed to delete expired refresh tokens:", err)
+			}
+			if err = DeleteExpiredSignedURLs(); err != nil {
+				log.Errorln("Failed to delete expired signed URLs:", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,101 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// RefreshToken is a long-lived token that can be exchanged for new access tokens. Each refresh token
+// can only be used once, and using it issues a new refresh token with the same scopes.
+type RefreshToken struct {
+	User string
+	// The scopes that access tokens issued with this refresh token are limited to. Empty if the
+	// access tokens aren't limited.
+	Scopes    []APIKeyScope
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+const refreshTokensSchema = `
+	hash      CHAR(64)     PRIMARY KEY,
+	user      VARCHAR(255) NOT NULL,
+	scopes    TEXT         NOT NULL,
+	createdAt BIGINT       NOT NULL,
+	expiresAt BIGINT       NOT NULL,
+	INDEX (user),
+	CONSTRAINT refreshtokens_user
+		FOREIGN KEY (user) REFERENCES users (email)
+		ON DELETE CASCADE
+		ON UPDATE RESTRICT
+`
+
+// CreateRefreshToken creates a refresh token for the given user. Only the hash of the token is stored.
+func CreateRefreshToken(email string, scopes []APIKeyScope, validFor time.Duration) (string, error) {
+	if err := ValidateScopes(scopes, true); err != nil {
+		return "", err
+	}
+	scopeData, err := json.Marshal(scopes)
+	if err != nil {
+		return "", err
+	}
+	token := SecureRandomString(48)
+	now := time.Now()
+	_, err = db.Exec("INSERT INTO refreshtokens (hash,user,scopes,createdAt,expiresAt) VALUES (?, ?, ?, ?, ?)",
+		hashToken(token), email, string(scopeData), now.Unix(), now.Add(validFor).Unix())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// UseRefreshToken consumes the given refresh token. Returns nil if the token is invalid, has expired
+// or was already used.
+func UseRefreshToken(token string) *RefreshToken {
+	hash := hashToken(token)
+	refresh := &RefreshToken{}
+	var scopeData string
+	var createdAt, expiresAt int64
+	err := db.QueryRow("SELECT user,scopes,createdAt,expiresAt FROM refreshtokens WHERE hash=?", hash).
+		Scan(&refresh.User, &scopeData, &createdAt, &expiresAt)
+	if err != nil || !RevokeRefreshToken(token) {
+		return nil
+	}
+	refresh.CreatedAt = time.Unix(createdAt, 0)
+	refresh.ExpiresAt = time.Unix(expiresAt, 0)
+	if !refresh.ExpiresAt.After(time.Now()) || json.Unmarshal([]byte(scopeData), &refresh.Scopes) != nil {
+		return nil
+	}
+	return refresh
+}
+
+// RevokeRefreshToken deletes the given refresh token. Returns false if the token didn't exist.
+func RevokeRefreshToken(token string) bool {
+	result, err := db.Exec("DELETE FROM refreshtokens WHERE hash=?", hashToken(token))
+	if err != nil {
+		return false
+	}
+	affected, err := result.RowsAffected()
+	return err == nil && affected > 0
+}
+
+// DeleteExpiredRefreshTokens deletes all refresh tokens that have expired.
+func DeleteExpiredRefreshTokens() error {
+	_, err := db.Exec("DELETE FROM refreshtokens WHERE expiresAt<=?", time.Now().Unix())
+	return err
+}
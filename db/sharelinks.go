@@ -0,0 +1,192 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ShareLink is a link with a random slug that gives anonymous access to a file or a namespace.
+type ShareLink struct {
+	Slug        string               `json:"slug"`
+	TargetType  PermissionTargetType `json:"targetType"`
+	Target      string               `json:"target"`
+	Permission  PermissionValue      `json:"permission"`
+	Password    []byte               `json:"-"`
+	CreatedBy   string               `json:"createdBy"`
+	CreatedAt   time.Time            `json:"createdAt"`
+	ExpiresAt   *time.Time           `json:"expiresAt,omitempty"`
+	Revoked     bool                 `json:"revoked"`
+	AccessCount int                  `json:"accessCount"`
+}
+
+const shareLinksSchema = `
+	slug        CHAR(32)          PRIMARY KEY,
+	targetType  TINYINT UNSIGNED  NOT NULL,
+	target      VARCHAR(255)      NOT NULL,
+	permission  SMALLINT UNSIGNED NOT NULL,
+	password    VARBINARY(60)     NOT NULL DEFAULT '',
+	createdBy   VARCHAR(255)      NOT NULL,
+	createdAt   BIGINT            NOT NULL,
+	expiresAt   BIGINT            NOT NULL DEFAULT 0,
+	revoked     BOOLEAN           NOT NULL DEFAULT FALSE,
+	accessCount INTEGER           NOT NULL DEFAULT 0,
+	INDEX (targetType, target),
+	INDEX (createdBy)
+`
+
+const shareLinkColumns = "slug,targetType,target,permission,password,createdBy,createdAt,expiresAt,revoked,accessCount"
+
+// ErrInvalidSharePermission is returned when trying to create a share link that would give more
+// than read or write access.
+var ErrInvalidSharePermission = errors.New("share links can only give read or write access")
+
+// CreateShareLink generates a slug for the given share link and inserts it into the database. If
+// the password is not empty, the link can only be used with the password.
+func CreateShareLink(link *ShareLink, password string) error {
+	if link.Permission&^PermissionReadWrite != 0 || !link.Permission.CanRead() {
+		return ErrInvalidSharePermission
+	}
+	if len(password) > 0 {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		link.Password = hash
+	}
+	link.Slug = SecureRandomString(32)
+	link.CreatedAt = time.Now()
+	var expiresAt int64
+	if link.ExpiresAt != nil {
+		expiresAt = link.ExpiresAt.Unix()
+	}
+	_, err := db.Exec("INSERT INTO sharelinks ("+shareLinkColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		link.Slug, int(link.TargetType), link.Target, uint8(link.Permission), link.Password, link.CreatedBy,
+		link.CreatedAt.Unix(), expiresAt, link.Revoked, link.AccessCount)
+	return err
+}
+
+// GetShareLink gets the share link with the given slug.
+func GetShareLink(slug string) *ShareLink {
+	link, _ := scanShareLinkRow(db.QueryRow("SELECT "+shareLinkColumns+" FROM sharelinks WHERE slug=?", slug))
+	return link
+}
+
+// GetShareLinksBy gets all share links created by the user with the given email.
+func GetShareLinksBy(email string) ([]*ShareLink, error) {
+	return queryShareLinks("SELECT "+shareLinkColumns+" FROM sharelinks WHERE createdBy=? ORDER BY createdAt", email)
+}
+
+// GetShareLinksTo gets all share links to the given target.
+func GetShareLinksTo(targetType PermissionTargetType, target string) ([]*ShareLink, error) {
+	return queryShareLinks("SELECT "+shareLinkColumns+" FROM sharelinks WHERE targetType=? AND target=? ORDER BY createdAt",
+		int(targetType), target)
+}
+
+func queryShareLinks(query string, args ...interface{}) ([]*ShareLink, error) {
+	results, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	links := []*ShareLink{}
+	for results.Next() {
+		link, err := scanShareLinkRow(results)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, results.Err()
+}
+
+func scanShareLinkRow(row scannable) (*ShareLink, error) {
+	link := &ShareLink{}
+	var targetType int
+	var permission uint8
+	var createdAt, expiresAt int64
+	err := row.Scan(&link.Slug, &targetType, &link.Target, &permission, &link.Password, &link.CreatedBy,
+		&createdAt, &expiresAt, &link.Revoked, &link.AccessCount)
+	if err != nil {
+		return nil, err
+	}
+	link.TargetType = PermissionTargetType(targetType)
+	link.Permission = PermissionValue(permission)
+	link.CreatedAt = time.Unix(createdAt, 0)
+	if expiresAt > 0 {
+		expiry := time.Unix(expiresAt, 0)
+		link.ExpiresAt = &expiry
+	}
+	return link, nil
+}
+
+func deleteShareLinks(ex execer, targetType PermissionTargetType, target string) error {
+	_, err := ex.Exec("DELETE FROM sharelinks WHERE targetType=? AND target=?", int(targetType), target)
+	return err
+}
+
+// HasPassword checks if this share link is protected with a password.
+func (link *ShareLink) HasPassword() bool {
+	return len(link.Password) > 0
+}
+
+// CheckPassword checks if the given password is correct for this share link. Links without a
+// password accept any password.
+func (link *ShareLink) CheckPassword(password string) bool {
+	return !link.HasPassword() || bcrypt.CompareHashAndPassword(link.Password, []byte(password)) == nil
+}
+
+// IsActive checks that this share link hasn't been revoked or expired.
+func (link *ShareLink) IsActive() bool {
+	return !link.Revoked && (link.ExpiresAt == nil || link.ExpiresAt.After(time.Now()))
+}
+
+// GetFile gets the file this share link points to, or nil if the link is for a namespace.
+func (link *ShareLink) GetFile() *File {
+	if link.TargetType != TypeFilePermission {
+		return nil
+	}
+	return GetFileByID(link.Target)
+}
+
+// GetNamespace gets the namespace this share link points to, or nil if the link is for a file.
+func (link *ShareLink) GetNamespace() *Namespace {
+	if link.TargetType != TypeNamespacePermission {
+		return nil
+	}
+	return GetNamespace(link.Target)
+}
+
+// CountAccess atomically increments the access counter of this share link.
+func (link *ShareLink) CountAccess() error {
+	_, err := db.Exec("UPDATE sharelinks SET accessCount=accessCount+1 WHERE slug=?", link.Slug)
+	if err == nil {
+		link.AccessCount++
+	}
+	return err
+}
+
+// Revoke revokes this share link. Revoked links are kept so that their access counts can still be
+// viewed.
+func (link *ShareLink) Revoke() error {
+	link.Revoked = true
+	_, err := db.Exec("UPDATE sharelinks SET revoked=TRUE WHERE slug=?", link.Slug)
+	return err
+}
@@ -0,0 +1,46 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"time"
+)
+
+// The nonces of signed URLs that have been used or revoked. They're kept until the URL expires, so
+// that each signed URL can only be used once.
+const usedSignedURLsSchema = `
+	nonce     CHAR(32) PRIMARY KEY,
+	expiresAt BIGINT   NOT NULL,
+	INDEX (expiresAt)
+`
+
+// UseSignedURL marks the signed URL with the given nonce as used until it expires. Returns false if
+// the URL was already used or revoked.
+func UseSignedURL(nonce string, expiresAt time.Time) (bool, error) {
+	result, err := db.Exec("INSERT IGNORE INTO usedsignedurls (nonce,expiresAt) VALUES (?, ?)", nonce, expiresAt.Unix())
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// DeleteExpiredSignedURLs forgets the used signed URLs that have expired.
+func DeleteExpiredSignedURLs() error {
+	_, err := db.Exec("DELETE FROM usedsignedurls WHERE expiresAt<=?", time.Now().Unix())
+	return err
+}
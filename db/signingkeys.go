@@ -0,0 +1,86 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"time"
+)
+
+// SigningKey is a key that the server signs access tokens with.
+type SigningKey struct {
+	ID         string
+	PrivateKey *ecdsa.PrivateKey
+	CreatedAt  time.Time
+}
+
+const signingKeysSchema = `
+	id         CHAR(16) PRIMARY KEY,
+	privateKey BLOB     NOT NULL,
+	createdAt  BIGINT   NOT NULL
+`
+
+// CreateSigningKey generates a new P-256 signing key and inserts it into the database.
+func CreateSigningKey() (*SigningKey, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	key := &SigningKey{ID: SecureRandomString(16), PrivateKey: privateKey, CreatedAt: time.Now()}
+	_, err = db.Exec("INSERT INTO signingkeys (id,privateKey,createdAt) VALUES (?, ?, ?)", key.ID, der, key.CreatedAt.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// GetSigningKeys gets all signing keys, newest first.
+func GetSigningKeys() ([]*SigningKey, error) {
+	results, err := db.Query("SELECT id,privateKey,createdAt FROM signingkeys ORDER BY createdAt DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	keys := []*SigningKey{}
+	for results.Next() {
+		key := &SigningKey{}
+		var der []byte
+		var createdAt int64
+		if err = results.Scan(&key.ID, &der, &createdAt); err != nil {
+			return nil, err
+		}
+		if key.PrivateKey, err = x509.ParseECPrivateKey(der); err != nil {
+			return nil, err
+		}
+		key.CreatedAt = time.Unix(createdAt, 0)
+		keys = append(keys, key)
+	}
+	return keys, results.Err()
+}
+
+// DeleteSigningKeysBefore deletes the signing keys created before the given time.
+func DeleteSigningKeysBefore(before time.Time) error {
+	_, err := db.Exec("DELETE FROM signingkeys WHERE createdAt<?", before.Unix())
+	return err
+}
@@ -0,0 +1,207 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// TOTP is the time-based one-time password generator of a user, as specified in RFC 6238.
+type TOTP struct {
+	User    string
+	Secret  string
+	Enabled bool
+	// The time step of the last accepted code. Codes can't be used more than once.
+	lastStep int64
+}
+
+const totpSchema = `
+	user     VARCHAR(255) PRIMARY KEY,
+	secret   VARCHAR(32)  NOT NULL,
+	enabled  BOOLEAN      NOT NULL DEFAULT FALSE,
+	lastStep BIGINT       NOT NULL DEFAULT 0,
+	CONSTRAINT totp_user
+		FOREIGN KEY (user) REFERENCES users (email)
+		ON DELETE CASCADE
+		ON UPDATE RESTRICT
+`
+
+const recoveryCodesSchema = `
+	user VARCHAR(255) NOT NULL,
+	hash CHAR(64)     NOT NULL,
+	PRIMARY KEY (user, hash),
+	CONSTRAINT recoverycodes_user
+		FOREIGN KEY (user) REFERENCES users (email)
+		ON DELETE CASCADE
+		ON UPDATE RESTRICT
+`
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// The number of time steps before and after the current one that are accepted to allow for
+	// clock drift.
+	totpSkew = 1
+
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 12
+)
+
+// GetTOTP gets the TOTP generator of this user, or nil if the user hasn't started enrolling.
+func (user *User) GetTOTP() *TOTP {
+	totp := &TOTP{User: user.Email}
+	err := db.QueryRow("SELECT secret,enabled,lastStep FROM totp WHERE user=?", user.Email).
+		Scan(&totp.Secret, &totp.Enabled, &totp.lastStep)
+	if err != nil {
+		return nil
+	}
+	return totp
+}
+
+// HasTOTP checks if this user has finished enrolling TOTP two-factor authentication.
+func (user *User) HasTOTP() bool {
+	totp := user.GetTOTP()
+	return totp != nil && totp.Enabled
+}
+
+// EnrollTOTP generates a new TOTP secret for this user. The secret isn't required when logging in
+// until it's enabled by verifying a code. Any unfinished enrollment is replaced.
+func (user *User) EnrollTOTP() (*TOTP, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	totp := &TOTP{
+		User:   user.Email,
+		Secret: base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret),
+	}
+	_, err := db.Exec("REPLACE INTO totp (user,secret,enabled,lastStep) VALUES (?, ?, false, 0)", totp.User, totp.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return totp, nil
+}
+
+// DisableTOTP removes the TOTP secret and recovery codes of this user.
+func (user *User) DisableTOTP() error {
+	_, err := db.Exec("DELETE FROM recoverycodes WHERE user=?", user.Email)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM totp WHERE user=?", user.Email)
+	return err
+}
+
+// GenerateRecoveryCodes replaces the recovery codes of this user with new ones. Only the hashes of the
+// codes are stored, so the returned codes can't be retrieved later.
+func (user *User) GenerateRecoveryCodes() ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM recoverycodes WHERE user=?", user.Email)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i] = SecureRandomString(recoveryCodeLength)
+		_, err = tx.Exec("INSERT INTO recoverycodes (user,hash) VALUES (?, ?)", user.Email, hashToken(codes[i]))
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// UseRecoveryCode checks if the given recovery code belongs to this user and removes it so that it
+// can't be used again.
+func (user *User) UseRecoveryCode(code string) bool {
+	result, err := db.Exec("DELETE FROM recoverycodes WHERE user=? AND hash=?", user.Email, hashToken(code))
+	if err != nil {
+		return false
+	}
+	affected, err := result.RowsAffected()
+	return err == nil && affected > 0
+}
+
+// ProvisioningURI gets the otpauth:// URI that authenticator apps can import, usually from a QR code.
+func (totp *TOTP) ProvisioningURI(issuer string) string {
+	query := url.Values{}
+	query.Set("secret", totp.Secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer + ":" + totp.User)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode())
+}
+
+// Verify checks the given code against the current time. Each code is only accepted once.
+func (totp *TOTP) Verify(code string) bool {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(totp.Secret)
+	if err != nil || len(code) != totpDigits {
+		return false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= totp.lastStep || subtle.ConstantTimeCompare([]byte(generateTOTPCode(key, step)), []byte(code)) != 1 {
+			continue
+		}
+		// Only accept the code if no other request used this or a later step in the meantime.
+		result, err := db.Exec("UPDATE totp SET lastStep=? WHERE user=? AND lastStep<?", step, totp.User, step)
+		if err != nil {
+			return false
+		}
+		affected, err := result.RowsAffected()
+		if err != nil || affected == 0 {
+			return false
+		}
+		totp.lastStep = step
+		return true
+	}
+	return false
+}
+
+// Enable marks the enrollment of this TOTP generator as finished.
+func (totp *TOTP) Enable() error {
+	totp.Enabled = true
+	_, err := db.Exec("UPDATE totp SET enabled=true WHERE user=?", totp.User)
+	return err
+}
+
+// generateTOTPCode generates the HOTP code (RFC 4226) of the given time step.
+func generateTOTPCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
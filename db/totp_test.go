@@ -0,0 +1,103 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The test secret of RFC 4226 and RFC 6238.
+const testTOTPKey = "12345678901234567890"
+
+func TestGenerateTOTPCodeRFC4226(t *testing.T) {
+	// The HOTP values from appendix D of RFC 4226.
+	expected := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for step, code := range expected {
+		if generated := generateTOTPCode([]byte(testTOTPKey), int64(step)); generated != code {
+			t.Errorf("Expected %s for counter %d, got %s", code, step, generated)
+		}
+	}
+}
+
+func TestGenerateTOTPCodeRFC6238(t *testing.T) {
+	// The SHA-1 values from appendix B of RFC 6238, truncated to six digits.
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		if generated := generateTOTPCode([]byte(testTOTPKey), test.time/totpPeriod); generated != test.code {
+			t.Errorf("Expected %s at %d, got %s", test.code, test.time, generated)
+		}
+	}
+}
+
+func newTestTOTP() (*TOTP, []byte) {
+	key := []byte(testTOTPKey)
+	return &TOTP{User: "user@example.com", Secret: base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key)}, key
+}
+
+func TestTOTPVerifyRejects(t *testing.T) {
+	totp, key := newTestTOTP()
+	step := time.Now().Unix() / totpPeriod
+	if totp.Verify(generateTOTPCode(key, step-totpSkew-1)) {
+		t.Error("Code from outside the allowed skew was accepted")
+	} else if totp.Verify(generateTOTPCode(key, step)[1:]) {
+		t.Error("Short code was accepted")
+	}
+
+	// Codes of steps that have already been used are rejected before touching the database.
+	totp.lastStep = step + totpSkew
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if totp.Verify(generateTOTPCode(key, s)) {
+			t.Errorf("Replayed code of step %d was accepted", s)
+		}
+	}
+
+	totp.Secret = "not base32!"
+	totp.lastStep = 0
+	if totp.Verify(generateTOTPCode(key, step)) {
+		t.Error("Code was accepted with an invalid secret")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	totp, _ := newTestTOTP()
+	uri, err := url.Parse(totp.ProvisioningURI("mauGFHS"))
+	if err != nil {
+		t.Fatal(err)
+	} else if uri.Scheme != "otpauth" || uri.Host != "totp" {
+		t.Errorf("Unexpected URI %s", uri)
+	} else if !strings.HasSuffix(uri.Path, "mauGFHS:user@example.com") {
+		t.Errorf("Unexpected label %s", uri.Path)
+	}
+	query := uri.Query()
+	if query.Get("secret") != totp.Secret || query.Get("issuer") != "mauGFHS" || query.Get("digits") != "6" {
+		t.Errorf("Unexpected parameters %s", uri.RawQuery)
+	}
+}
@@ -17,6 +17,9 @@
 package db
 
 import (
+	"crypto/subtle"
+	"time"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -25,30 +28,201 @@ type User struct {
 	Email    string
 	Password []byte
 	Admin    bool
+	// Service accounts can't log in with a password and are only used through API keys.
+	ServiceAccount bool
+	// The API key the user authenticated with, or nil if an API key wasn't used.
+	apiKey *APIKey
+	// The IP address the request of the user came from, and the collector of the admin overrides
+	// of the request.
+	clientIP  string
+	overrides *AdminOverrides
 }
 
 const usersSchema = `
 	email VARCHAR(255) PRIMARY KEY,
 	password BINARY(60) NOT NULL,
-	admin BOOLEAN NOT NULL
+	admin BOOLEAN NOT NULL,
+	serviceAccount BOOLEAN NOT NULL DEFAULT FALSE
 `
 
+// migrateUsers adds the columns that were added to the users table after it was created.
+func migrateUsers() {
+	addColumn("users", "serviceAccount", "BOOLEAN NOT NULL DEFAULT FALSE")
+}
+
 // GetUser gets the user with the given email.
 func GetUser(email string) *User {
-	row := db.QueryRow(`SELECT email,password,admin FROM users WHERE email=?`, email)
-	if row != nil {
-		var email string
-		var password []byte
-		var admin bool
-		row.Scan(&email, &password, &admin)
-		return &User{Email: email, Password: password, Admin: admin}
+	row := db.QueryRow(`SELECT email,password,admin,serviceAccount FROM users WHERE email=?`, email)
+	var password []byte
+	var admin, serviceAccount bool
+	err := row.Scan(&email, &password, &admin, &serviceAccount)
+	if err != nil {
+		return nil
 	}
-	return nil
+	return &User{Email: email, Password: password, Admin: admin, ServiceAccount: serviceAccount}
+}
+
+// CreateUser creates a user without a password. Such users can only log in through external
+// identity providers until they set a password.
+func CreateUser(email string) (*User, error) {
+	user := &User{Email: email, Password: make([]byte, 60)}
+	if err := user.Insert(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// CreateServiceAccount creates a service account with the given name and grants it the given
+// permissions to namespaces in a single transaction. The name is used in place of an email address.
+func CreateServiceAccount(name string, permissions map[string]PermissionValue) (*User, error) {
+	user := &User{Email: name, Password: make([]byte, 60), ServiceAccount: true}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = user.insert(tx)
+	for namespace, pv := range permissions {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("INSERT INTO nspermissions (user,namespace,permission) VALUES (?, ?, ?)", user.Email, namespace, uint8(pv))
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	} else if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Insert inserts this user into the database.
+func (user *User) Insert() error {
+	return user.insert(db)
+}
+
+func (user *User) insert(ex execer) error {
+	_, err := ex.Exec(`INSERT INTO users (email,password,admin,serviceAccount) VALUES (?, ?, ?, ?)`,
+		user.Email, user.Password, user.Admin, user.ServiceAccount)
+	return err
+}
+
+// SetAdmin changes whether or not this user is an admin.
+func (user *User) SetAdmin(admin bool) error {
+	user.Admin = admin
+	_, err := db.Exec(`UPDATE users SET admin=? WHERE email=?`, user.Admin, user.Email)
+	return err
+}
+
+// SyncGroupNamespacePermissions replaces the namespace permissions that the given source has granted
+// this user based on their groups. Grants from the source to namespaces that aren't in the given
+// permissions are removed. Manual grants and grants from other sources are never changed, even if
+// the groups give permissions to the same namespace. Returns the grants that were added, changed or
+// removed, with PermissionNothing for removed grants.
+func (user *User) SyncGroupNamespacePermissions(source string, permissions map[string]PermissionValue) (map[string]PermissionValue, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	results, err := tx.Query("SELECT namespace,permission,source FROM nspermissions WHERE user=? FOR UPDATE", user.Email)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	existing := make(map[string]PermissionValue)
+	existingSource := make(map[string]string)
+	for results.Next() {
+		var namespace, grantSource string
+		var pv uint8
+		if err = results.Scan(&namespace, &pv, &grantSource); err != nil {
+			break
+		}
+		existing[namespace] = PermissionValue(pv)
+		existingSource[namespace] = grantSource
+	}
+	results.Close()
+
+	changes := make(map[string]PermissionValue)
+	for namespace := range existing {
+		if _, ok := permissions[namespace]; err == nil && !ok && existingSource[namespace] == source {
+			_, err = tx.Exec("DELETE FROM nspermissions WHERE user=? AND namespace=?", user.Email, namespace)
+			changes[namespace] = PermissionNothing
+		}
+	}
+	for namespace, pv := range permissions {
+		if err != nil {
+			break
+		} else if oldPV, ok := existing[namespace]; !ok {
+			_, err = tx.Exec("INSERT INTO nspermissions (user,namespace,permission,source) VALUES (?, ?, ?, ?)",
+				user.Email, namespace, uint8(pv), source)
+			changes[namespace] = pv
+		} else if existingSource[namespace] == source && oldPV != pv {
+			_, err = tx.Exec("UPDATE nspermissions SET permission=? WHERE user=? AND namespace=?", uint8(pv), user.Email, namespace)
+			changes[namespace] = pv
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	} else if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// NewTokenUser creates a user from the claims of a self-contained access token without loading it
+// from the database. If scopes are given, the user is limited to them like an API key and isn't an
+// admin.
+func NewTokenUser(email string, admin bool, scopes []APIKeyScope) *User {
+	user := &User{Email: email, Admin: admin}
+	if len(scopes) > 0 {
+		user.apiKey = &APIKey{User: email, Name: "access token", Scopes: scopes}
+		user.Admin = false
+	}
+	return user
+}
+
+// SetClientIP sets the IP address the current request of this user came from. It's recorded in the
+// audit log for actions done in the db package.
+func (user *User) SetClientIP(ip string) {
+	user.clientIP = ip
+}
+
+// SetAdminOverrides sets the collector that the admin overrides of this user are added to. If it's
+// not set, each override is recorded immediately.
+func (user *User) SetAdminOverrides(overrides *AdminOverrides) {
+	user.overrides = overrides
+}
+
+func (user *User) recordOverride(ep *EffectivePermission) {
+	if user.overrides != nil {
+		user.overrides.add(user, ep)
+		return
+	}
+	overrides := &AdminOverrides{}
+	overrides.add(user, ep)
+	overrides.Record()
+}
+
+// GetAPIKey gets the API key this user authenticated with, or nil if the user didn't use an API key.
+func (user *User) GetAPIKey() *APIKey {
+	return user.apiKey
+}
+
+// userEmail gets the email of the given user, or an empty string if the user is nil.
+func userEmail(user *User) string {
+	if user == nil {
+		return ""
+	}
+	return user.Email
 }
 
 // CheckPassword checks if the given password is correct.
 func (user *User) CheckPassword(password []byte) bool {
-	return bcrypt.CompareHashAndPassword(user.Password, password) != nil
+	if user.ServiceAccount {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(user.Password, password) == nil
 }
 
 // ResetPassword resets the password of this user.
@@ -58,18 +232,19 @@ func (user *User) ResetPassword(newPassword []byte) bool {
 	return err == nil
 }
 
-// GetAuthTokens gets the auth tokens of the user.
+// GetAuthTokens gets the auth tokens of the user. Only the hashes of the tokens are available.
 func (user *User) GetAuthTokens() []AuthToken {
-	results, err := db.Query(`SELECT user,token,createdBy,expiry,isRecovery FROM authtokens WHERE user=? AND is_recovery=0`, user.Email)
+	results, err := db.Query("SELECT "+authTokenColumns+" FROM authtokens WHERE user=? AND isRecovery=0", user.Email)
 	if err != nil {
 		return []AuthToken{}
 	}
 	return scanAuthTokens(results)
 }
 
-// GetRecoveryTokens gets the password recovery tokens of the user.
+// GetRecoveryTokens gets the password recovery tokens of the user. Only the hashes of the tokens are
+// available.
 func (user *User) GetRecoveryTokens() []AuthToken {
-	results, err := db.Query(`SELECT user,token,createdBy,expiry,isRecovery FROM authtokens WHERE user=? AND is_recovery=1`, user.Email)
+	results, err := db.Query("SELECT "+authTokenColumns+" FROM authtokens WHERE user=? AND isRecovery=1", user.Email)
 	if err != nil {
 		return []AuthToken{}
 	}
@@ -78,22 +253,35 @@ func (user *User) GetRecoveryTokens() []AuthToken {
 
 // CheckAuthToken checks if the given authentication token is valid for this user.
 func (user *User) CheckAuthToken(token string) bool {
-	for _, at := range user.GetAuthTokens() {
-		if at.Token == token {
-			return true
-		}
-	}
-	return false
+	return user.checkToken(token, false)
 }
 
 // CheckRecoveryToken checks if the given recovery token is valid for this user.
 func (user *User) CheckRecoveryToken(token string) bool {
-	for _, at := range user.GetRecoveryTokens() {
-		if at.Token == token {
-			return true
-		}
+	return user.checkToken(token, true)
+}
+
+// checkToken looks up the given token by its hash and checks that it belongs to this user and
+// hasn't expired. The stored hash is also compared in constant time.
+func (user *User) checkToken(token string, isRecovery bool) bool {
+	hash := hashToken(token)
+	at := scanAuthToken(db.QueryRow("SELECT "+authTokenColumns+" FROM authtokens WHERE hash=?", hash))
+	if at == nil || subtle.ConstantTimeCompare([]byte(at.Hash), []byte(hash)) != 1 {
+		return false
 	}
-	return false
+	return at.User == user.Email && at.IsRecovery == isRecovery && !at.HasExpired()
+}
+
+// CreateAuthToken creates a new authentication or password recovery token for this user. Only the
+// hash of the token is stored, so the returned token can't be retrieved later.
+func (user *User) CreateAuthToken(createdBy string, validFor time.Duration, isRecovery bool) (string, error) {
+	token := SecureRandomString(64)
+	_, err := db.Exec("INSERT INTO authtokens ("+authTokenColumns+") VALUES (?, ?, ?, ?, ?)",
+		user.Email, hashToken(token), createdBy, time.Now().Add(validFor).Unix(), isRecovery)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
 }
 
 // GetPermissionsToFiles returns the file permissions this user has.
@@ -107,13 +295,19 @@ func (user *User) GetPermissionsToFiles() []Permission {
 
 // GetPermissionToFile gets the permission this user has to the given file.
 func (user *User) GetPermissionToFile(file *File) Permission {
-	row := db.QueryRow(`SELECT user,file,permission FROM filepermissions WHERE user=? AND file=?`, user.Email, file.ID)
-	if row == nil {
+	perm := user.getFileGrant(file)
+	if perm == nil {
 		return &FilePermission{basePermission{User: user.Email, Target: file.ID, Permission: PermissionNothing}}
 	}
-	return scanFilePermission(row)
+	return perm
 }
 
+// getFileGrant gets the explicit permission row this user has to the given file, or nil if there is none.
+func (user *User) getFileGrant(file *File) Permission {
+	return scanFilePermission(db.QueryRow(`SELECT user,file,permission FROM filepermissions WHERE user=? AND file=?`, user.Email, file.ID))
+}
+
+// GetPermissionValueToFile gets the value of the explicit permission this user has to the given file.
 func (user *User) GetPermissionValueToFile(file *File) PermissionValue {
 	return user.GetPermissionToFile(file).GetPermission()
 }
@@ -129,13 +323,19 @@ func (user *User) GetPermissionsToNamespaces() []Permission {
 
 // GetPermissionToNamespace gets the permission this user has to the given namespace.
 func (user *User) GetPermissionToNamespace(ns *Namespace) Permission {
-	row := db.QueryRow(`SELECT user,file,permission FROM filepermissions WHERE user=? AND file=?`, user.Email, ns.Name)
-	if row == nil {
+	perm := user.getNamespaceGrant(ns)
+	if perm == nil {
 		return &NamespacePermission{basePermission{User: user.Email, Target: ns.Name, Permission: PermissionNothing}}
 	}
-	return scanNamespacePermission(row)
+	return perm
+}
+
+// getNamespaceGrant gets the explicit permission row this user has to the given namespace, or nil if there is none.
+func (user *User) getNamespaceGrant(ns *Namespace) Permission {
+	return scanNamespacePermission(db.QueryRow(`SELECT user,namespace,permission FROM nspermissions WHERE user=? AND namespace=?`, user.Email, ns.Name))
 }
 
+// GetPermissionValueToNamespace gets the value of the explicit permission this user has to the given namespace.
 func (user *User) GetPermissionValueToNamespace(ns *Namespace) PermissionValue {
 	return user.GetPermissionToNamespace(ns).GetPermission()
 }
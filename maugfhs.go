@@ -20,8 +20,10 @@ import (
 	"fmt"
 	"os"
 
+	"maunium.net/go/mauGFHS/auth"
 	configpkg "maunium.net/go/mauGFHS/config"
 	"maunium.net/go/mauGFHS/db"
+	"maunium.net/go/mauGFHS/web"
 	flag "maunium.net/go/mauflag"
 	log "maunium.net/go/maulogger"
 )
@@ -63,5 +65,17 @@ func main() {
 		os.Exit(1)
 	}
 	db.CreateTables()
+	if err = auth.Configure(config.Auth); err != nil {
+		log.Fatalf("Failed to configure authentication: %v\n", err)
+		os.Exit(1)
+	}
+	if config.FullTextIndex.Enabled {
+		db.EnableFullTextIndex(config.FullTextIndex.MaxLength)
+	}
+	if config.ReaperInterval > 0 {
+		db.StartReaper(config.ReaperInterval)
+	}
 
+	log.Infof("Listening on %s:%d\n", config.Listen.Address, config.Listen.Port)
+	web.Open()
 }
@@ -0,0 +1,303 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/db"
+)
+
+// accessTokenClaims are the claims of the JWT access tokens issued by mauGFHS.
+type accessTokenClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	IssuedAt int64  `json:"iat"`
+	Expiry   int64  `json:"exp"`
+	Admin    bool   `json:"admin,omitempty"`
+	// The namespaces and permissions the token is limited to, like the scopes of API keys. The token
+	// has all the permissions of the user if empty.
+	Scopes []db.APIKeyScope `json:"scopes,omitempty"`
+}
+
+type accessTokenRequest struct {
+	Scopes []db.APIKeyScope `json:"scopes"`
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type accessTokenResponse struct {
+	AccessToken  string `json:"accessToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int64  `json:"expiresIn"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// signingKeyReloadInterval limits how often the signing keys are reloaded from the database when a
+// token signed with an unknown key is received.
+const signingKeyReloadInterval = 10 * time.Second
+
+var (
+	signingKeys       []*db.SigningKey
+	signingKeysLoaded time.Time
+	signingKeysLock   sync.Mutex
+)
+
+// loadSigningKeys loads the signing keys from the database, generates a new key if the newest one is
+// older than the rotation interval and deletes keys that can't have signed any unexpired tokens. The
+// caller must hold signingKeysLock.
+func loadSigningKeys() error {
+	keys, err := db.GetSigningKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 || time.Since(keys[0].CreatedAt) >= config.Auth.JWT.GetKeyRotationInterval() {
+		key, err := db.CreateSigningKey()
+		if err != nil {
+			return err
+		}
+		log.Infof("Generated new access token signing key %s\n", key.ID)
+		keys = append([]*db.SigningKey{key}, keys...)
+	}
+	// A key stops being used when the next key is created, so it's no longer needed once the
+	// lifetime of access tokens has passed since then.
+	cutoff := time.Now().Add(-config.Auth.JWT.GetAccessTokenLifetime())
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1].CreatedAt.Before(cutoff) {
+			if err = db.DeleteSigningKeysBefore(keys[i-1].CreatedAt); err != nil {
+				log.Warnln("Failed to delete old signing keys:", err)
+			}
+			keys = keys[:i]
+			break
+		}
+	}
+	signingKeys = keys
+	signingKeysLoaded = time.Now()
+	return nil
+}
+
+// getSigningKey gets the key that new access tokens are signed with.
+func getSigningKey() (*db.SigningKey, error) {
+	signingKeysLock.Lock()
+	defer signingKeysLock.Unlock()
+	if len(signingKeys) == 0 || time.Since(signingKeys[0].CreatedAt) >= config.Auth.JWT.GetKeyRotationInterval() {
+		if err := loadSigningKeys(); err != nil {
+			return nil, err
+		}
+	}
+	return signingKeys[0], nil
+}
+
+// findSigningKey gets the signing key with the given ID. The keys are reloaded if the key isn't
+// known, as it may have been generated by another server using the same database.
+func findSigningKey(id string) *db.SigningKey {
+	signingKeysLock.Lock()
+	defer signingKeysLock.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		for _, key := range signingKeys {
+			if key.ID == id {
+				return key
+			}
+		}
+		if attempt > 0 || time.Since(signingKeysLoaded) < signingKeyReloadInterval {
+			break
+		} else if err := loadSigningKeys(); err != nil {
+			log.Errorln("Failed to load signing keys:", err)
+			break
+		}
+	}
+	return nil
+}
+
+// getAccessToken gets the JWT access token from the Authorization header of the request, or an empty
+// string if the header doesn't contain an access token. API keys never contain dots, so they can't be
+// mistaken for JWTs.
+func getAccessToken(r *http.Request) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !config.Auth.JWT.Enabled || strings.Count(token, ".") != 2 {
+		return ""
+	}
+	return token
+}
+
+// verifyAccessToken checks the signature and claims of the given access token and returns the user
+// it was issued to. The user isn't loaded from the database.
+func verifyAccessToken(token string) *db.User {
+	jwt, err := parseJWT(token)
+	if err != nil || jwt.Header.Algorithm != "ES256" {
+		return nil
+	}
+	key := findSigningKey(jwt.Header.KeyID)
+	if key == nil || jwt.Verify(&key.PrivateKey.PublicKey) != nil {
+		return nil
+	}
+	var claims accessTokenClaims
+	if err = json.Unmarshal(jwt.Payload, &claims); err != nil {
+		return nil
+	}
+	now := time.Now()
+	if claims.Issuer != config.Auth.JWT.GetIssuer() || len(claims.Subject) == 0 ||
+		claims.Expiry <= now.Unix() || claims.IssuedAt > now.Add(time.Minute).Unix() {
+		return nil
+	}
+	return db.NewTokenUser(claims.Subject, claims.Admin, claims.Scopes)
+}
+
+// issueAccessToken creates an access token and a refresh token for the user and sends them in the
+// response. Returns false if creating the tokens failed.
+func issueAccessToken(w http.ResponseWriter, user *db.User, scopes []db.APIKeyScope) bool {
+	refreshToken, err := db.CreateRefreshToken(user.Email, scopes, config.Auth.JWT.GetRefreshTokenLifetime())
+	if err == db.ErrInvalidScope {
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	} else if err != nil {
+		log.Errorf("Failed to create refresh token for %s: %v\n", user.Email, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	key, err := getSigningKey()
+	if err != nil {
+		log.Errorln("Failed to get signing key:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	now := time.Now()
+	lifetime := config.Auth.JWT.GetAccessTokenLifetime()
+	accessToken, err := signJWT(accessTokenClaims{
+		Issuer:   config.Auth.JWT.GetIssuer(),
+		Subject:  user.Email,
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(lifetime).Unix(),
+		Admin:    user.Admin && len(scopes) == 0,
+		Scopes:   scopes,
+	}, key.ID, key.PrivateKey)
+	if err != nil {
+		log.Errorf("Failed to sign access token for %s: %v\n", user.Email, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	writeJSON(w, http.StatusOK, accessTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(lifetime.Seconds()),
+		RefreshToken: refreshToken,
+	})
+	return true
+}
+
+// IssueAccessToken handles a request to get an access token and a refresh token. The request must be
+// authenticated with an auth token, and the tokens can be limited to scopes like API keys.
+func IssueAccessToken(w http.ResponseWriter, r *http.Request) {
+	if !config.Auth.JWT.Enabled {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	} else if len(getAccessToken(r)) > 0 {
+		// Access tokens can't be used to get new tokens, as that would allow using them indefinitely.
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	user := getKeyManager(w, r)
+	if user == nil {
+		return
+	}
+	var req accessTokenRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if issueAccessToken(w, user, req.Scopes) {
+		audit(r, user, db.AuditTokenCreated, db.AuditTargetUser, user.Email, "access token and refresh token")
+	}
+}
+
+// RefreshAccessToken handles a request to exchange a refresh token for a new access token and refresh
+// token with the same scopes. Refreshes aren't recorded in the audit log, as they happen every few
+// minutes for each client.
+func RefreshAccessToken(w http.ResponseWriter, r *http.Request) {
+	if !config.Auth.JWT.Enabled {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	var req refreshTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ip := clientIPKey(r)
+	if !checkLockout(w, ip, "") {
+		return
+	}
+	refresh := db.UseRefreshToken(req.RefreshToken)
+	if refresh == nil {
+		recordFailure(limitIP, ip)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	user := db.GetUser(refresh.User)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	restrictAdmin(r, user)
+	issueAccessToken(w, user, refresh.Scopes)
+}
+
+// RevokeRefreshToken handles a request to revoke a refresh token. Access tokens that were already
+// issued stay valid until they expire.
+func RevokeRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req refreshTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if !db.RevokeRefreshToken(req.RefreshToken) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	audit(r, nil, db.AuditTokenRevoked, db.AuditTargetRefreshToken, "", "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetJWKS handles a request to get the public keys that access tokens are signed with.
+func GetJWKS(w http.ResponseWriter, r *http.Request) {
+	if !config.Auth.JWT.Enabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if _, err := getSigningKey(); err != nil {
+		log.Errorln("Failed to get signing keys:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	signingKeysLock.Lock()
+	jwks := jsonWebKeySet{Keys: make([]jsonWebKey, len(signingKeys))}
+	for i, key := range signingKeys {
+		jwks.Keys[i] = newECJSONWebKey(key.ID, &key.PrivateKey.PublicKey)
+	}
+	signingKeysLock.Unlock()
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, jwks)
+}
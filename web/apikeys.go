@@ -0,0 +1,196 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/db"
+)
+
+type apiKeyRequest struct {
+	Name string `json:"name"`
+	// The user the key is created for. Only admins can create keys for other users.
+	User string `json:"user"`
+	// The number of seconds until the key expires. Zero means that the key never expires.
+	ExpiresIn int64            `json:"expiresIn"`
+	Scopes    []db.APIKeyScope `json:"scopes"`
+}
+
+type apiKeyResponse struct {
+	*db.APIKey
+	Key string `json:"key"`
+}
+
+// getKeyManager authenticates a request to manage API keys or other credentials. API keys can't be
+// used to manage credentials.
+func getKeyManager(w http.ResponseWriter, r *http.Request) *db.User {
+	user := CheckAuth(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	} else if user.GetAPIKey() != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	return user
+}
+
+// CreateAPIKey handles an API key creation request. The secret key is only included in the response
+// to this request.
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	user := getKeyManager(w, r)
+	if user == nil {
+		return
+	}
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ExpiresIn < 0 || len(req.Name) == 0 || len(req.Name) > 255 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(req.User) == 0 {
+		req.User = user.Email
+	} else if req.User != user.Email && !user.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if db.GetUser(req.User) == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	key := &db.APIKey{
+		User:      req.User,
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		CreatedBy: user.Email,
+	}
+	if req.ExpiresIn > 0 {
+		expiry := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+		key.ExpiresAt = &expiry
+	}
+	secret, err := db.CreateAPIKey(key)
+	if err == db.ErrInvalidScope {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Errorf("Failed to create API key for %s: %v\n", key.User, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	audit(r, user, db.AuditTokenCreated, db.AuditTargetAPIKey, key.ID, "API key "+key.Name+" for "+key.User)
+	writeJSON(w, http.StatusCreated, apiKeyResponse{APIKey: key, Key: secret})
+}
+
+// ListAPIKeys handles a request to list the API keys of the user. Admins can list the keys of other
+// users with the "user" query parameter.
+func ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user := getKeyManager(w, r)
+	if user == nil {
+		return
+	}
+	email := r.URL.Query().Get("user")
+	if len(email) == 0 {
+		email = user.Email
+	} else if email != user.Email && !user.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	keys, err := db.GetAPIKeys(email)
+	if err != nil {
+		log.Errorf("Failed to get API keys of %s: %v\n", email, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// DeleteAPIKey handles an API key deletion request.
+func DeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	user := getKeyManager(w, r)
+	if user == nil {
+		return
+	}
+	key := db.GetAPIKey(mux.Vars(r)["id"])
+	if key == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if key.User != user.Email && !user.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := key.Delete(); err != nil {
+		log.Errorf("Failed to delete API key %s: %v\n", key.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	audit(r, user, db.AuditTokenRevoked, db.AuditTargetAPIKey, key.ID, "API key "+key.Name+" for "+key.User)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type serviceAccountRequest struct {
+	Name string `json:"name"`
+	// Namespace permissions to grant to the service account.
+	Permissions map[string]db.PermissionValue `json:"permissions"`
+}
+
+// CreateServiceAccount handles a request to create a service account. Only admins can create service
+// accounts.
+func CreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	user := getKeyManager(w, r)
+	if user == nil {
+		return
+	} else if !user.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var req serviceAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Name) == 0 || len(req.Name) > 255 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if db.GetUser(req.Name) != nil {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	for nsName := range req.Permissions {
+		if db.GetNamespace(nsName) == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	account, err := db.CreateServiceAccount(req.Name, req.Permissions)
+	if err != nil {
+		log.Errorf("Failed to create service account %s: %v\n", req.Name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for nsName, pv := range req.Permissions {
+		audit(r, user, db.AuditPermissionChanged, db.TypeNamespacePermission.String(), nsName,
+			fmt.Sprintf("service account %s granted permission %d", account.Email, pv))
+	}
+	log.Infof("Admin %s created service account %s\n", user.Email, account.Email)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"name":        account.Email,
+		"permissions": req.Permissions,
+	})
+}
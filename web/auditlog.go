@@ -0,0 +1,139 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/db"
+)
+
+// audit records an action in the audit log. The actor may be nil for anonymous actions.
+func audit(r *http.Request, actor *db.User, action db.AuditAction, targetType, target, details string) {
+	event := &db.AuditEvent{
+		Action:     action,
+		TargetType: targetType,
+		Target:     target,
+		Details:    details,
+	}
+	if actor != nil {
+		event.Actor = actor.Email
+	}
+	if ip := GetClientIP(r); ip != nil {
+		event.IP = ip.String()
+	}
+	db.RecordAuditEvent(event)
+}
+
+type adminOverridesKey struct{}
+
+// recordAdminOverrides collects the admin overrides of each request and records them as a single
+// audit event after the request has been handled.
+func recordAdminOverrides(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		overrides := &db.AdminOverrides{}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminOverridesKey{}, overrides)))
+		overrides.Record()
+	})
+}
+
+// parseAuditQuery reads the audit log filters from the query parameters of the given request.
+func parseAuditQuery(r *http.Request, paginate bool) (query db.AuditQuery, ok bool) {
+	params := r.URL.Query()
+	query = db.AuditQuery{
+		Actor:      params.Get("actor"),
+		Action:     db.AuditAction(params.Get("action")),
+		TargetType: params.Get("targetType"),
+		Target:     params.Get("target"),
+		IP:         params.Get("ip"),
+	}
+	if query.After, ok = parseTime(params.Get("after")); !ok {
+		return
+	} else if query.Before, ok = parseTime(params.Get("before")); !ok {
+		return
+	} else if paginate {
+		query.Offset, query.Limit, ok = getPagination(params.Get("offset"), params.Get("limit"))
+	}
+	return
+}
+
+// getAuditor authenticates a request to read the audit log. Only admins can read the audit log.
+func getAuditor(w http.ResponseWriter, r *http.Request) *db.User {
+	user := CheckAuth(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	} else if !user.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	return user
+}
+
+// ListAuditEvents handles a request to read a page of the audit log. The events can be filtered by
+// the actor, action, targetType, target, ip, after and before query parameters. A target filter also
+// matches targets under the given namespace.
+func ListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	if getAuditor(w, r) == nil {
+		return
+	}
+	query, ok := parseAuditQuery(r, true)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	events, err := db.GetAuditEvents(query)
+	if err != nil {
+		log.Errorln("Failed to read audit log:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// ExportAuditLog handles a request to export all audit events matching the filters of
+// ListAuditEvents as JSON lines. The export isn't limited by the write timeout of the server, as
+// large exports take longer to send.
+func ExportAuditLog(w http.ResponseWriter, r *http.Request) {
+	if getAuditor(w, r) == nil {
+		return
+	}
+	query, ok := parseAuditQuery(r, false)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Errorln("Failed to clear write deadline for audit log export:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	if err := db.ScanAuditLog(query, func(event *db.AuditEvent) error {
+		return encoder.Encode(event)
+	}); err != nil {
+		log.Errorln("Failed to export audit log:", err)
+	}
+}
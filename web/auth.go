@@ -17,7 +17,10 @@
 package web
 
 import (
+	"crypto/rand"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/sessions"
 
@@ -25,15 +28,116 @@ import (
 	log "maunium.net/go/maulogger"
 )
 
-var store = sessions.NewCookieStore([]byte("something-very-secret"))
+var store *sessions.CookieStore
 
-// CheckAuth checks if the given request is authenticated.
+// initSessionStore creates the session cookie store with the configured key.
+func initSessionStore() {
+	key := []byte(config.Auth.Session.Key)
+	if len(key) == 0 {
+		log.Warnln("No session key configured, generating a random one. Sessions won't survive restarts.")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatalln("Failed to generate session key:", err)
+		}
+	}
+	store = sessions.NewCookieStore(key)
+	store.Options.HttpOnly = true
+	store.Options.Secure = !config.Auth.Session.Insecure
+	store.Options.SameSite = http.SameSiteLaxMode
+}
+
+// CheckAuth checks if the given request is authenticated with an auth token, an API key or an
+// access token. Invalid credentials in the headers count as failures of the client IP address.
 func CheckAuth(r *http.Request) *db.User {
+	user := checkAuth(r)
+	if user == nil && hasAuthHeaders(r) {
+		recordFailure(limitIP, clientIPKey(r))
+	} else if user != nil {
+		setRequestUser(r, user)
+	}
+	return user
+}
+
+// setRequestUser prepares a user that the given request is made on behalf of. The client IP address
+// and admin overrides are recorded for the audit log, and admin privileges are restricted.
+func setRequestUser(r *http.Request, user *db.User) {
+	if ip := GetClientIP(r); ip != nil {
+		user.SetClientIP(ip.String())
+	}
+	if overrides, ok := r.Context().Value(adminOverridesKey{}).(*db.AdminOverrides); ok {
+		user.SetAdminOverrides(overrides)
+	}
+	restrictAdmin(r, user)
+}
+
+// restrictAdmin revokes the admin privileges of the user if the request doesn't come from a network
+// where admin access is allowed, or if TOTP is required for admins and the user hasn't enabled it.
+func restrictAdmin(r *http.Request, user *db.User) {
+	if !user.Admin {
+		return
+	} else if !config.Admin.IsAllowedAddress(GetClientIP(r)) {
+		log.Debugf("Ignoring admin privileges of %s: request from disallowed address %s\n", user.Email, GetClientIP(r))
+		user.Admin = false
+	} else if config.Auth.TOTP.RequireForAdmins && !user.HasTOTP() {
+		log.Debugf("Ignoring admin privileges of %s: TOTP not enabled\n", user.Email)
+		user.Admin = false
+	}
+}
+
+// startSession creates an auth token for the given user and stores it in the session cookie.
+// The token is returned so that it can also be used in the AuthToken header.
+func startSession(w http.ResponseWriter, r *http.Request, user *db.User, createdBy string) (string, error) {
+	token, err := user.CreateAuthToken(createdBy, config.Auth.GetTokenLifetime(), false)
+	if err != nil {
+		return "", err
+	}
+	session, _ := store.Get(r, "maugfhs")
+	session.Values["authToken"] = token
+	session.Values["authUser"] = user.Email
+	return token, session.Save(r, w)
+}
+
+// GetClientIP gets the IP address of the client that sent the given request. Proxy headers are
+// only used if the TrustHeaders config option is enabled and the request came from a trusted proxy.
+// X-Forwarded-For is read from the right, skipping trusted proxies, since the leftmost entries are
+// set by the client.
+func GetClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if !config.Listen.TrustHeaders || (len(config.Listen.TrustedProxies) > 0 && !config.Listen.IsTrustedProxy(ip)) {
+		return ip
+	}
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip = net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil || !config.Listen.IsTrustedProxy(ip) {
+				return ip
+			}
+		}
+		return ip
+	} else if realIP := r.Header.Get("X-Real-IP"); len(realIP) > 0 {
+		return net.ParseIP(strings.TrimSpace(realIP))
+	}
+	return ip
+}
+
+func checkAuth(r *http.Request) *db.User {
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		if token := getAccessToken(r); len(token) > 0 {
+			return verifyAccessToken(token)
+		}
+		return db.GetUserByAPIKey(strings.TrimPrefix(authHeader, "Bearer "))
+	}
+
 	tokenStr := r.Header.Get("AuthToken")
 	userStr := r.Header.Get("AuthUser")
 	if len(tokenStr) > 0 && len(userStr) > 0 {
 		user := db.GetUser(userStr)
-		if user.CheckAuthToken(tokenStr) {
+		if user != nil && user.CheckAuthToken(tokenStr) {
 			return user
 		}
 		return nil
@@ -45,11 +149,11 @@ func CheckAuth(r *http.Request) *db.User {
 		return nil
 	}
 
-	tokenStr = session.Values["authToken"].(string)
-	userStr = session.Values["authUser"].(string)
+	tokenStr, _ = session.Values["authToken"].(string)
+	userStr, _ = session.Values["authUser"].(string)
 	if len(tokenStr) > 0 && len(userStr) > 0 {
 		user := db.GetUser(userStr)
-		if user.CheckAuthToken(tokenStr) {
+		if user != nil && user.CheckAuthToken(tokenStr) {
 			return user
 		}
 		return nil
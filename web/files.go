@@ -0,0 +1,321 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/db"
+)
+
+// permissionInfo describes the permissions of the caller in API responses.
+type permissionInfo struct {
+	Value     db.PermissionValue `json:"value"`
+	CanRead   bool               `json:"canRead"`
+	CanWrite  bool               `json:"canWrite"`
+	IsCreator bool               `json:"isCreator"`
+}
+
+func makePermissionInfo(pv db.PermissionValue) permissionInfo {
+	return permissionInfo{Value: pv, CanRead: pv.CanRead(), CanWrite: pv.CanWrite(), IsCreator: pv.IsCreator()}
+}
+
+type fileMetadata struct {
+	*db.File
+	Path        string            `json:"path"`
+	Metadata    map[string]string `json:"metadata"`
+	Tags        []string          `json:"tags"`
+	Permissions permissionInfo    `json:"permissions"`
+}
+
+// checkFileExists responds with an error if the given file doesn't exist, has expired or has run
+// out of downloads.
+func checkFileExists(w http.ResponseWriter, file *db.File) bool {
+	if file == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	} else if file.IsGone() {
+		w.WriteHeader(http.StatusGone)
+		return false
+	}
+	return true
+}
+
+// permissionChecker is a file or namespace whose permissions can be checked.
+type permissionChecker interface {
+	HasPermission(user *db.User, check func(db.PermissionValue) bool) bool
+}
+
+// checkFileAccess responds with an error if the given file doesn't exist, the given user doesn't
+// have the permission required by the check function or the file has expired or run out of
+// downloads. The permission is checked first so that users who can't access the file can't tell
+// whether it's gone.
+func checkFileAccess(w http.ResponseWriter, file *db.File, user *db.User, check func(db.PermissionValue) bool) bool {
+	if file == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	} else if !file.HasPermission(user, check) {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return checkFileExists(w, file)
+}
+
+// GetFileMetadataByID handles an ID-based file metadata request.
+func GetFileMetadataByID(w http.ResponseWriter, r *http.Request) {
+	getFileMetadata(w, r, db.GetFileByID(mux.Vars(r)["id"]))
+}
+
+// GetFileMetadataByPath handles a path-based file metadata request.
+func GetFileMetadataByPath(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	getFileMetadata(w, r, db.GetFileByPath(vars["namespace"], vars["name"]))
+}
+
+func getFileMetadata(w http.ResponseWriter, r *http.Request, file *db.File) {
+	user := CheckAuth(r)
+	if !checkFileAccess(w, file, user, db.PermissionValue.CanRead) {
+		return
+	}
+	pv := file.GetPermissionsFor(user)
+	writeJSON(w, http.StatusOK, fileMetadata{
+		File:        file,
+		Path:        file.Path(),
+		Metadata:    file.GetMetadata(),
+		Tags:        file.GetTags(),
+		Permissions: makePermissionInfo(pv),
+	})
+}
+
+type updateMetadataRequest struct {
+	Metadata map[string]*string `json:"metadata"`
+	Tags     *[]string          `json:"tags"`
+}
+
+// UpdateFileMetadataByID handles an ID-based file metadata update request.
+func UpdateFileMetadataByID(w http.ResponseWriter, r *http.Request) {
+	updateFileMetadata(w, r, db.GetFileByID(mux.Vars(r)["id"]))
+}
+
+// UpdateFileMetadataByPath handles a path-based file metadata update request.
+func UpdateFileMetadataByPath(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	updateFileMetadata(w, r, db.GetFileByPath(vars["namespace"], vars["name"]))
+}
+
+// updateFileMetadata changes the custom metadata and tags of the given file. Metadata keys with a
+// null value are removed and the tags are replaced if given.
+func updateFileMetadata(w http.ResponseWriter, r *http.Request, file *db.File) {
+	user := CheckAuth(r)
+	if !checkFileAccess(w, file, user, db.PermissionValue.CanWrite) {
+		return
+	}
+	var req updateMetadataRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if len(req.Metadata) > 0 {
+		err = file.UpdateMetadata(req.Metadata)
+	}
+	if err == nil && req.Tags != nil {
+		err = file.SetTags(*req.Tags)
+	}
+	if db.IsInvalidMetadataError(err) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Errorf("Failed to update metadata of %s: %v\n", file.Path(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	getFileMetadata(w, r, file)
+}
+
+// DeleteFileByID handles an ID-based DELETE request.
+func DeleteFileByID(w http.ResponseWriter, r *http.Request) {
+	deleteFile(w, r, db.GetFileByID(mux.Vars(r)["id"]))
+}
+
+// DeleteFileByPath handles a path-based DELETE request.
+func DeleteFileByPath(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	deleteFile(w, r, db.GetFileByPath(vars["namespace"], vars["name"]))
+}
+
+func deleteFile(w http.ResponseWriter, r *http.Request, file *db.File) {
+	user := CheckAuth(r)
+	if !checkFileAccess(w, file, user, db.PermissionValue.CanWrite) {
+		return
+	}
+	if err := file.Delete(); err != nil {
+		log.Errorf("Failed to delete file %s: %v\n", file.Path(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	audit(r, user, db.AuditFileDeleted, db.TypeFilePermission.String(), file.Path(), "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MoveFileByID handles an ID-based file rename or move request.
+func MoveFileByID(w http.ResponseWriter, r *http.Request) {
+	moveFile(w, r, db.GetFileByID(mux.Vars(r)["id"]))
+}
+
+// MoveFileByPath handles a path-based file rename or move request.
+func MoveFileByPath(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	moveFile(w, r, db.GetFileByPath(vars["namespace"], vars["name"]))
+}
+
+func moveFile(w http.ResponseWriter, r *http.Request, file *db.File) {
+	user := CheckAuth(r)
+	if !checkFileAccess(w, file, user, db.PermissionValue.CanWrite) {
+		return
+	}
+	ns, name, replace, ok := getFileTarget(w, r, user, file, false)
+	if !ok {
+		return
+	}
+	oldPath := file.Path()
+	if err := file.MoveTo(ns.Name, name, replace); err != nil {
+		log.Errorf("Failed to move file %s to %s/%s: %v\n", oldPath, ns.Name, name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	auditReplace(r, user, replace, oldPath)
+	audit(r, user, db.AuditFileMoved, db.TypeFilePermission.String(), file.Path(), "moved from "+oldPath)
+	writeJSON(w, http.StatusOK, file)
+}
+
+// CopyFileByID handles an ID-based file copy request.
+func CopyFileByID(w http.ResponseWriter, r *http.Request) {
+	copyFile(w, r, db.GetFileByID(mux.Vars(r)["id"]))
+}
+
+// CopyFileByPath handles a path-based file copy request.
+func CopyFileByPath(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	copyFile(w, r, db.GetFileByPath(vars["namespace"], vars["name"]))
+}
+
+func copyFile(w http.ResponseWriter, r *http.Request, file *db.File) {
+	user := CheckAuth(r)
+	if !checkFileAccess(w, file, user, db.PermissionValue.CanRead) {
+		return
+	}
+	ns, name, replace, ok := getFileTarget(w, r, user, file, true)
+	if !ok {
+		return
+	}
+	copied, err := file.CopyTo(ns, name, user, replace)
+	if err != nil {
+		log.Errorf("Failed to copy file %s to %s/%s: %v\n", file.Path(), ns.Name, name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	auditReplace(r, user, replace, file.Path())
+	audit(r, user, db.AuditFileCopied, db.TypeFilePermission.String(), copied.Path(), "copied from "+file.Path())
+	writeJSON(w, http.StatusCreated, copied)
+}
+
+type fileTargetRequest struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// getFileTarget reads the target location of a move or copy request and checks that the given file
+// can be put there by the given user. The namespace defaults to the current namespace of the file
+// and the name to the current name, or a generated name if the target namespace requires it.
+//
+// If there's already a file at the target location, it's returned as the file to replace if the
+// overwrite query parameter is set and the user is allowed to overwrite it, or if it has expired or
+// run out of downloads. Otherwise the request fails with a conflict.
+func getFileTarget(w http.ResponseWriter, r *http.Request, user *db.User, file *db.File, copying bool) (*db.Namespace, string, *db.File, bool) {
+	var req fileTargetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.ContainsRune(req.Name, '/') {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, "", nil, false
+	}
+	if len(req.Namespace) == 0 {
+		req.Namespace = file.Namespace
+	}
+
+	ns := db.GetNamespace(req.Namespace)
+	if ns == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, "", nil, false
+	} else if !ns.HasPermission(user, db.PermissionValue.CanWrite) {
+		w.WriteHeader(http.StatusForbidden)
+		return nil, "", nil, false
+	}
+
+	if len(req.Name) == 0 {
+		if ns.ShouldGenerateNames() && (copying || ns.Name != file.Namespace) {
+			req.Name = ns.GenerateFileName(file.Name)
+		} else {
+			req.Name = file.Name
+		}
+	} else if ns.ShouldGenerateNames() {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, "", nil, false
+	}
+
+	if !ns.IsNameAllowed(req.Name) {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, "", nil, false
+	} else if !ns.IsMIMEAllowed(file.MIME) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return nil, "", nil, false
+	} else if maxSize := ns.GetMaxFileSize(); maxSize > 0 && int64(file.Size) > maxSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return nil, "", nil, false
+	}
+
+	existing := db.GetFileByPath(ns.Name, req.Name)
+	if existing == nil || (!copying && existing.ID == file.ID) {
+		return ns, req.Name, nil, true
+	} else if existing.ID != file.ID && existing.IsGone() {
+		return ns, req.Name, existing, true
+	} else if existing.ID == file.ID || r.URL.Query().Get("overwrite") != "true" || !ns.CanOverwrite() {
+		w.WriteHeader(http.StatusConflict)
+		return nil, "", nil, false
+	} else if !existing.HasPermission(user, db.PermissionValue.CanWrite) {
+		w.WriteHeader(http.StatusForbidden)
+		return nil, "", nil, false
+	}
+	return ns, req.Name, existing, true
+}
+
+// auditReplace records the replacement of a file by a move or copy in the audit log. Replaced files
+// that had expired or run out of downloads are recorded as deleted.
+func auditReplace(r *http.Request, user *db.User, replaced *db.File, source string) {
+	if replaced == nil {
+		return
+	} else if replaced.IsGone() {
+		audit(r, user, db.AuditFileDeleted, db.TypeFilePermission.String(), replaced.Path(), "expired or out of downloads, replaced with "+source)
+	} else {
+		audit(r, user, db.AuditFileOverwritten, db.TypeFilePermission.String(), replaced.Path(), "replaced with "+source)
+	}
+}
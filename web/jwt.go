@@ -0,0 +1,239 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	// Register the hash functions used by the supported signature algorithms.
+	_ "crypto/sha512"
+)
+
+// Errors returned when parsing and verifying JWTs.
+var (
+	errMalformedJWT        = errors.New("malformed JWT")
+	errUnsupportedJWTAlg   = errors.New("unsupported JWT signature algorithm")
+	errInvalidJWTSignature = errors.New("invalid JWT signature")
+	errUnknownJWK          = errors.New("unknown JSON web key")
+)
+
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// parsedJWT is a JWT that has been split and decoded, but not verified.
+type parsedJWT struct {
+	Header       jwtHeader
+	Payload      []byte
+	signingInput []byte
+	signature    []byte
+}
+
+func parseJWT(token string) (*parsedJWT, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedJWT
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errMalformedJWT
+	}
+	jwt := &parsedJWT{signingInput: []byte(parts[0] + "." + parts[1])}
+	if err = json.Unmarshal(headerData, &jwt.Header); err != nil {
+		return nil, errMalformedJWT
+	} else if jwt.Payload, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return nil, errMalformedJWT
+	} else if jwt.signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return nil, errMalformedJWT
+	}
+	return jwt, nil
+}
+
+// Verify checks the signature of the JWT with the given public key.
+func (jwt *parsedJWT) Verify(key crypto.PublicKey) error {
+	hashType, ok := jwtHashes[jwt.Header.Algorithm]
+	if !ok {
+		return errUnsupportedJWTAlg
+	}
+	hash := hashType.New()
+	hash.Write(jwt.signingInput)
+	digest := hash.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(jwt.Header.Algorithm, "RS") {
+			return errUnsupportedJWTAlg
+		} else if rsa.VerifyPKCS1v15(key, hashType, digest, jwt.signature) != nil {
+			return errInvalidJWTSignature
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(jwt.Header.Algorithm, "ES") {
+			return errUnsupportedJWTAlg
+		} else if len(jwt.signature) != 2*size {
+			return errInvalidJWTSignature
+		}
+		r := new(big.Int).SetBytes(jwt.signature[:size])
+		s := new(big.Int).SetBytes(jwt.signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errInvalidJWTSignature
+		}
+	default:
+		return errUnsupportedJWTAlg
+	}
+	return nil
+}
+
+// signJWT creates a JWT with the given claims signed with ES256. The key must be a P-256 key.
+func signJWT(claims interface{}, keyID string, key *ecdsa.PrivateKey) (string, error) {
+	header, err := json.Marshal(jwtHeader{Algorithm: "ES256", KeyID: keyID, Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	signature := append(padBigInt(r, size), padBigInt(s, size)...)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// padBigInt encodes the given number as a big-endian byte array of the given size.
+func padBigInt(n *big.Int, size int) []byte {
+	data := n.Bytes()
+	padded := make([]byte, size)
+	copy(padded[size-len(data):], data)
+	return padded
+}
+
+// jsonWebKey is a public key in the JSON web key format.
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Elliptic curve keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// newECJSONWebKey converts an elliptic curve public key used for ES256 signatures into a JSON web key.
+func newECJSONWebKey(keyID string, key *ecdsa.PublicKey) jsonWebKey {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return jsonWebKey{
+		KeyType:   "EC",
+		KeyID:     keyID,
+		Use:       "sig",
+		Algorithm: "ES256",
+		Curve:     key.Curve.Params().Name,
+		X:         base64.RawURLEncoding.EncodeToString(padBigInt(key.X, size)),
+		Y:         base64.RawURLEncoding.EncodeToString(padBigInt(key.Y, size)),
+	}
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+func decodeBigInt(data string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+// PublicKey converts the JSON web key into a Go public key.
+func (jwk jsonWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Curve)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.KeyType)
+}
+
+// Find gets the key that was used to sign the given JWT.
+func (jwks jsonWebKeySet) Find(jwt *parsedJWT) (crypto.PublicKey, error) {
+	for _, jwk := range jwks.Keys {
+		if (len(jwt.Header.KeyID) == 0 || jwk.KeyID == jwt.Header.KeyID) && (len(jwk.Use) == 0 || jwk.Use == "sig") {
+			return jwk.PublicKey()
+		}
+	}
+	return nil, errUnknownJWK
+}
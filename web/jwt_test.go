@@ -0,0 +1,217 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"maunium.net/go/mauGFHS/db"
+)
+
+func generateTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// useTestSigningKey replaces the access token signing keys with a single generated key. The keys
+// are marked as freshly loaded so that unknown key IDs don't trigger a database lookup.
+func useTestSigningKey(t *testing.T) *db.SigningKey {
+	key := &db.SigningKey{ID: "test", PrivateKey: generateTestKey(t), CreatedAt: time.Now()}
+	signingKeysLock.Lock()
+	signingKeys = []*db.SigningKey{key}
+	signingKeysLoaded = time.Now()
+	signingKeysLock.Unlock()
+	t.Cleanup(func() {
+		signingKeysLock.Lock()
+		signingKeys = nil
+		signingKeysLoaded = time.Time{}
+		signingKeysLock.Unlock()
+	})
+	return key
+}
+
+func testAccessTokenClaims() accessTokenClaims {
+	now := time.Now()
+	return accessTokenClaims{
+		Issuer:   config.Auth.JWT.GetIssuer(),
+		Subject:  "user@example.com",
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(time.Minute).Unix(),
+		Admin:    true,
+	}
+}
+
+func signTestJWT(t *testing.T, claims interface{}, keyID string, key *ecdsa.PrivateKey) string {
+	token, err := signJWT(claims, keyID, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWTSignAndVerify(t *testing.T) {
+	key := generateTestKey(t)
+	jwt, err := parseJWT(signTestJWT(t, map[string]string{"sub": "user"}, "key", key))
+	if err != nil {
+		t.Fatal(err)
+	} else if jwt.Header.Algorithm != "ES256" || jwt.Header.KeyID != "key" {
+		t.Errorf("Unexpected header %+v", jwt.Header)
+	} else if err = jwt.Verify(&key.PublicKey); err != nil {
+		t.Error("Valid signature was rejected:", err)
+	} else if err = jwt.Verify(&generateTestKey(t).PublicKey); err != errInvalidJWTSignature {
+		t.Errorf("Expected invalid signature with wrong key, got %v", err)
+	}
+}
+
+func TestJWTJSONWebKey(t *testing.T) {
+	key := generateTestKey(t)
+	token := signTestJWT(t, map[string]string{"sub": "user"}, "key", key)
+	jwt, err := parseJWT(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(jsonWebKeySet{Keys: []jsonWebKey{newECJSONWebKey("key", &key.PublicKey)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jwks jsonWebKeySet
+	if err = json.Unmarshal(data, &jwks); err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := jwks.Find(jwt)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = jwt.Verify(publicKey); err != nil {
+		t.Error("Signature was rejected with key from JWKS:", err)
+	}
+	jwt.Header.KeyID = "other"
+	if _, err = jwks.Find(jwt); err != errUnknownJWK {
+		t.Errorf("Expected unknown key, got %v", err)
+	}
+}
+
+func TestJWTRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user"}`))
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt, err := parseJWT(signingInput + "." + base64.RawURLEncoding.EncodeToString(signature))
+	if err != nil {
+		t.Fatal(err)
+	} else if err = jwt.Verify(&key.PublicKey); err != nil {
+		t.Error("Valid RSA signature was rejected:", err)
+	} else if err = jwt.Verify(&generateTestKey(t).PublicKey); err != errUnsupportedJWTAlg {
+		t.Errorf("Expected RS256 token to be rejected with an EC key, got %v", err)
+	}
+}
+
+func TestJWTMalformed(t *testing.T) {
+	key := generateTestKey(t)
+	valid := signTestJWT(t, map[string]string{"sub": "user"}, "key", key)
+	parts := strings.Split(valid, ".")
+	for _, token := range []string{"", "a.b", "a.b.c.d", "!.b.c", parts[0] + ".!." + parts[2], parts[0] + "." + parts[1] + ".!"} {
+		if _, err := parseJWT(token); err != errMalformedJWT {
+			t.Errorf("Expected %q to be malformed, got %v", token, err)
+		}
+	}
+
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+	jwt, err := parseJWT(none)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = jwt.Verify(&key.PublicKey); err != errUnsupportedJWTAlg {
+		t.Errorf("Expected unsigned token to be rejected, got %v", err)
+	}
+}
+
+func TestVerifyAccessToken(t *testing.T) {
+	key := useTestSigningKey(t)
+	user := verifyAccessToken(signTestJWT(t, testAccessTokenClaims(), key.ID, key.PrivateKey))
+	if user == nil {
+		t.Fatal("Valid access token was rejected")
+	} else if user.Email != "user@example.com" || !user.Admin || user.GetAPIKey() != nil {
+		t.Errorf("Unexpected user %+v", user)
+	}
+
+	claims := testAccessTokenClaims()
+	claims.Scopes = []db.APIKeyScope{{Namespace: "foo", Permission: db.PermissionRead}}
+	user = verifyAccessToken(signTestJWT(t, claims, key.ID, key.PrivateKey))
+	if user == nil {
+		t.Fatal("Valid scoped access token was rejected")
+	} else if user.Admin || user.GetAPIKey() == nil {
+		t.Error("Scoped access token wasn't limited to its scopes")
+	}
+}
+
+func TestVerifyAccessTokenRejects(t *testing.T) {
+	key := useTestSigningKey(t)
+	tests := []struct {
+		name   string
+		modify func(claims *accessTokenClaims)
+		keyID  string
+		key    *ecdsa.PrivateKey
+	}{
+		{"wrong key", nil, key.ID, generateTestKey(t)},
+		{"unknown key", nil, "unknown", key.PrivateKey},
+		{"wrong issuer", func(claims *accessTokenClaims) { claims.Issuer = "other" }, key.ID, key.PrivateKey},
+		{"no subject", func(claims *accessTokenClaims) { claims.Subject = "" }, key.ID, key.PrivateKey},
+		{"expired", func(claims *accessTokenClaims) { claims.Expiry = time.Now().Unix() }, key.ID, key.PrivateKey},
+		{"future", func(claims *accessTokenClaims) { claims.IssuedAt = time.Now().Add(time.Hour).Unix() }, key.ID, key.PrivateKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := testAccessTokenClaims()
+			if test.modify != nil {
+				test.modify(&claims)
+			}
+			if verifyAccessToken(signTestJWT(t, claims, test.keyID, test.key)) != nil {
+				t.Error("Invalid access token was accepted")
+			}
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		parts := strings.Split(signTestJWT(t, testAccessTokenClaims(), key.ID, key.PrivateKey), ".")
+		claims := testAccessTokenClaims()
+		claims.Subject = "admin@example.com"
+		payload, _ := json.Marshal(claims)
+		parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+		if verifyAccessToken(strings.Join(parts, ".")) != nil {
+			t.Error("Tampered access token was accepted")
+		}
+	})
+}
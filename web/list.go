@@ -0,0 +1,171 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/db"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+type listResponse struct {
+	Namespace  string     `json:"namespace"`
+	Namespaces []string   `json:"namespaces"`
+	Files      []*db.File `json:"files"`
+	Total      int        `json:"total"`
+	Offset     int        `json:"offset"`
+	Limit      int        `json:"limit"`
+}
+
+// ListNamespace handles a namespace content listing request.
+//
+// The query parameters "offset" and "limit" are used for pagination, "sort" and "order" for sorting
+// files, "prefix" for filtering by name and "recursive" for including the contents of all
+// namespaces under the requested namespace. Files can also be filtered by tags using "tag" and by
+// custom metadata using "meta.<key>". Child namespaces are always listed before files.
+func ListNamespace(w http.ResponseWriter, r *http.Request) {
+	ns := db.GetNamespace(mux.Vars(r)["namespace"])
+	if ns == nil {
+		namespaceNotFound(w, r)
+		return
+	}
+	user := CheckAuth(r)
+	if !ns.HasPermission(user, db.PermissionValue.CanRead) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	offset, limit, ok := getPagination(query.Get("offset"), query.Get("limit"))
+	sortBy := query.Get("sort")
+	if len(sortBy) == 0 {
+		sortBy = "name"
+	}
+	if _, validSort := db.FileSortFields[sortBy]; !ok || !validSort {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	descending := query.Get("order") == "desc"
+	prefix := query.Get("prefix")
+
+	// Files are only listed from the child namespaces in recursive mode.
+	namespaces := []string{ns.Name}
+	var children []*db.Namespace
+	if query.Get("recursive") == "true" {
+		children = ns.GetDescendants()
+		for _, child := range children {
+			namespaces = append(namespaces, child.Name)
+		}
+	} else {
+		children = ns.GetChildren()
+	}
+
+	resp := listResponse{Namespace: ns.Name, Namespaces: []string{}, Files: []*db.File{}, Offset: offset, Limit: limit}
+	for _, child := range children {
+		if child.HasPermission(user, db.PermissionValue.CanRead) && strings.HasPrefix(child.Name[strings.LastIndexByte(child.Name, '/')+1:], prefix) {
+			resp.Namespaces = append(resp.Namespaces, child.Name)
+		}
+	}
+	sort.Strings(resp.Namespaces)
+	if descending && sortBy == "name" {
+		sort.Sort(sort.Reverse(sort.StringSlice(resp.Namespaces)))
+	}
+
+	fileQuery := db.FileQuery{
+		Namespaces:     namespaces,
+		Prefix:         prefix,
+		Tags:           query["tag"],
+		Metadata:       getMetadataFilter(query),
+		SortBy:         sortBy,
+		Descending:     descending,
+		FilterReadable: true,
+		Reader:         user,
+	}
+	fileCount, err := db.CountFiles(fileQuery)
+	if err != nil {
+		log.Errorf("Failed to count files in %s: %v\n", ns.Name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Total = len(resp.Namespaces) + fileCount
+
+	// Child namespaces are listed first, so the file page starts after them.
+	nsCount := len(resp.Namespaces)
+	resp.Namespaces = resp.Namespaces[clamp(offset, nsCount):clamp(offset+limit, nsCount)]
+	fileQuery.Offset = clamp(offset-nsCount, fileCount)
+	fileQuery.Limit = limit - len(resp.Namespaces)
+	if fileQuery.Limit > 0 && fileQuery.Offset < fileCount {
+		resp.Files, err = db.ListFiles(fileQuery)
+		if err != nil {
+			log.Errorf("Failed to list files in %s: %v\n", ns.Name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// getMetadataFilter reads the custom metadata filters from the given query.
+func getMetadataFilter(query url.Values) map[string]string {
+	filter := make(map[string]string)
+	for key, values := range query {
+		if strings.HasPrefix(key, "meta.") && len(values) > 0 {
+			filter[key[len("meta."):]] = values[0]
+		}
+	}
+	return filter
+}
+
+// getPagination parses the given offset and limit query parameters.
+func getPagination(offsetStr, limitStr string) (offset, limit int, ok bool) {
+	limit = defaultListLimit
+	var err error
+	if len(offsetStr) > 0 {
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return 0, 0, false
+		}
+	}
+	if len(limitStr) > 0 {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return 0, 0, false
+		}
+	}
+	return offset, limit, true
+}
+
+func clamp(val, upper int) int {
+	if val < 0 {
+		return 0
+	} else if val > upper {
+		return upper
+	}
+	return val
+}
@@ -0,0 +1,191 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/auth"
+	"maunium.net/go/mauGFHS/db"
+)
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type totpLoginRequest struct {
+	LoginToken   string `json:"loginToken"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// pendingLogin is a password or OpenID Connect login that is waiting for the second factor.
+type pendingLogin struct {
+	user      string
+	createdBy string
+	method    string
+	expires   time.Time
+	attempts  int
+}
+
+const (
+	pendingLoginLifetime    = 5 * time.Minute
+	maxPendingLoginAttempts = 5
+)
+
+var (
+	pendingLogins     = make(map[string]*pendingLogin)
+	pendingLoginsLock sync.Mutex
+)
+
+// Login handles a password login request. The credentials are checked against the configured
+// authenticators. If the user has enabled TOTP, a login token for finishing the login with
+// FinishTOTPLogin is returned. Otherwise an auth token is returned and stored in the session cookie.
+func Login(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ip := clientIPKey(r)
+	if !checkLockout(w, ip, req.Username) {
+		return
+	}
+	user, err := auth.Authenticate(req.Username, req.Password)
+	if err != nil {
+		log.Debugf("Failed login for %s from %s\n", req.Username, ip)
+		audit(r, nil, db.AuditLoginFailed, db.AuditTargetUser, req.Username, "password")
+		recordFailure(limitIP, ip)
+		recordFailure(limitAccount, req.Username)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !user.HasTOTP() {
+		clearFailures(limitAccount, req.Username)
+		finishLogin(w, r, user, "login", "password")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"user":         user.Email,
+		"totpRequired": true,
+		"loginToken":   startPendingLogin(user, "login", "password"),
+	})
+}
+
+// startPendingLogin stores a login that has passed the first factor and returns the login token for
+// finishing it with FinishTOTPLogin.
+func startPendingLogin(user *db.User, createdBy, method string) string {
+	loginToken := db.SecureRandomString(32)
+	now := time.Now()
+	pendingLoginsLock.Lock()
+	for token, pending := range pendingLogins {
+		if now.After(pending.expires) {
+			delete(pendingLogins, token)
+		}
+	}
+	pendingLogins[loginToken] = &pendingLogin{
+		user:      user.Email,
+		createdBy: createdBy,
+		method:    method,
+		expires:   now.Add(pendingLoginLifetime),
+	}
+	pendingLoginsLock.Unlock()
+	return loginToken
+}
+
+// FinishTOTPLogin handles the second step of a password or OpenID Connect login for users who have
+// enabled TOTP. The request must contain the login token from the first step and either a TOTP code
+// or a recovery code.
+func FinishTOTPLogin(w http.ResponseWriter, r *http.Request) {
+	var req totpLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	pendingLoginsLock.Lock()
+	pending, ok := pendingLogins[req.LoginToken]
+	if ok {
+		pending.attempts++
+		if time.Now().After(pending.expires) || pending.attempts > maxPendingLoginAttempts {
+			delete(pendingLogins, req.LoginToken)
+			ok = false
+		}
+	}
+	pendingLoginsLock.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	ip := clientIPKey(r)
+	if !checkLockout(w, ip, pending.user) {
+		return
+	}
+	user := db.GetUser(pending.user)
+	if user == nil || !checkSecondFactor(user, req.Code, req.RecoveryCode) {
+		log.Debugf("Failed second factor for %s from %s\n", pending.user, ip)
+		audit(r, nil, db.AuditLoginFailed, db.AuditTargetUser, pending.user, "second factor")
+		recordFailure(limitIP, ip)
+		recordFailure(limitAccount, pending.user)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	clearFailures(limitAccount, pending.user)
+	pendingLoginsLock.Lock()
+	delete(pendingLogins, req.LoginToken)
+	pendingLoginsLock.Unlock()
+	if len(req.Code) > 0 {
+		finishLogin(w, r, user, pending.createdBy, pending.method+" and TOTP")
+	} else {
+		finishLogin(w, r, user, pending.createdBy, pending.method+" and recovery code")
+	}
+}
+
+// checkSecondFactor checks the given TOTP code or recovery code of the user. Recovery codes are
+// consumed when used.
+func checkSecondFactor(user *db.User, code, recoveryCode string) bool {
+	if len(code) > 0 {
+		totp := user.GetTOTP()
+		return totp != nil && totp.Enabled && totp.Verify(code)
+	} else if len(recoveryCode) > 0 {
+		return user.UseRecoveryCode(recoveryCode)
+	}
+	return false
+}
+
+// finishLogin creates an auth token for the user and sends it in the response. The login is recorded
+// in the audit log with the given authentication method.
+func finishLogin(w http.ResponseWriter, r *http.Request, user *db.User, createdBy, method string) {
+	token, err := startSession(w, r, user, createdBy)
+	if err != nil {
+		log.Errorf("Failed to create auth token for %s: %v\n", user.Email, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Infof("%s logged in from %s\n", user.Email, GetClientIP(r))
+	audit(r, user, db.AuditLogin, db.AuditTargetUser, user.Email, method)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"user":      user.Email,
+		"authToken": token,
+	})
+}
@@ -0,0 +1,365 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/db"
+)
+
+// optionalList is a list in a JSON request that can be either absent (don't change), null (unset
+// and inherit from parent) or an array.
+type optionalList struct {
+	Set   bool
+	Value []string
+}
+
+// UnmarshalJSON marks the list as set and parses the value.
+func (ol *optionalList) UnmarshalJSON(data []byte) error {
+	ol.Set = true
+	return json.Unmarshal(data, &ol.Value)
+}
+
+func (ol optionalList) apply(target *[]string) {
+	if ol.Set {
+		*target = ol.Value
+	}
+}
+
+// optionalInt is an integer in a JSON request that works like optionalList.
+type optionalInt struct {
+	Set   bool
+	Value *int64
+}
+
+// UnmarshalJSON marks the integer as set and parses the value.
+func (oi *optionalInt) UnmarshalJSON(data []byte) error {
+	oi.Set = true
+	return json.Unmarshal(data, &oi.Value)
+}
+
+func (oi optionalInt) apply(target **int64) {
+	if oi.Set {
+		*target = oi.Value
+	}
+}
+
+// optionalString is a string in a JSON request that works like optionalList.
+type optionalString struct {
+	Set   bool
+	Value *string
+}
+
+// UnmarshalJSON marks the string as set and parses the value.
+func (ostr *optionalString) UnmarshalJSON(data []byte) error {
+	ostr.Set = true
+	return json.Unmarshal(data, &ostr.Value)
+}
+
+func (ostr optionalString) apply(target **string) {
+	if ostr.Set {
+		*target = ostr.Value
+	}
+}
+
+// optionalBool is a boolean in a JSON request that works like optionalList.
+type optionalBool struct {
+	Set   bool
+	Value *bool
+}
+
+// UnmarshalJSON marks the boolean as set and parses the value.
+func (ob *optionalBool) UnmarshalJSON(data []byte) error {
+	ob.Set = true
+	return json.Unmarshal(data, &ob.Value)
+}
+
+func (ob optionalBool) apply(target **bool) {
+	if ob.Set {
+		*target = ob.Value
+	}
+}
+
+type namespaceRequest struct {
+	DefaultPermissions *db.PermissionValue `json:"defaultPermissions"`
+	MIMETypes          optionalList        `json:"mimeTypes"`
+	DeniedMIMETypes    optionalList        `json:"deniedMimeTypes"`
+	Extensions         optionalList        `json:"extensions"`
+	DeniedExtensions   optionalList        `json:"deniedExtensions"`
+	MaxFileSize        optionalInt         `json:"maxFileSize"`
+	NamePattern        optionalString      `json:"namePattern"`
+	AllowOverwrite     optionalBool        `json:"allowOverwrite"`
+	GenerateNames      optionalBool        `json:"generateNames"`
+	DefaultTTL         optionalInt         `json:"defaultTTL"`
+	MaxTTL             optionalInt         `json:"maxTTL"`
+}
+
+func (req namespaceRequest) apply(ns *db.Namespace) error {
+	if req.DefaultPermissions != nil {
+		ns.DefaultPermissions = *req.DefaultPermissions
+	}
+	req.MIMETypes.apply(&ns.MIMETypes)
+	req.DeniedMIMETypes.apply(&ns.DeniedMIMETypes)
+	req.Extensions.apply(&ns.Extensions)
+	req.DeniedExtensions.apply(&ns.DeniedExtensions)
+	req.MaxFileSize.apply(&ns.MaxFileSize)
+	req.NamePattern.apply(&ns.NamePattern)
+	req.AllowOverwrite.apply(&ns.AllowOverwrite)
+	req.GenerateNames.apply(&ns.GenerateNames)
+	req.DefaultTTL.apply(&ns.DefaultTTL)
+	req.MaxTTL.apply(&ns.MaxTTL)
+	if ns.MaxFileSize != nil && *ns.MaxFileSize < 0 {
+		return fmt.Errorf("negative maximum file size")
+	} else if ns.DefaultTTL != nil && *ns.DefaultTTL < 0 {
+		return fmt.Errorf("negative default TTL")
+	} else if ns.MaxTTL != nil && *ns.MaxTTL < 0 {
+		return fmt.Errorf("negative maximum TTL")
+	} else if ns.NamePattern != nil {
+		return db.ValidateNamePattern(*ns.NamePattern)
+	}
+	return nil
+}
+
+type namespaceResponse struct {
+	*db.Namespace
+	Children []string `json:"children"`
+}
+
+// CreateNamespace handles a namespace creation request.
+func CreateNamespace(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["namespace"]
+	if !db.IsValidNamespaceName(name) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if db.GetNamespace(name) != nil {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	user := CheckAuth(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	parent := db.GetNearestParent(name)
+	if parent == nil && !user.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if parent != nil && !parent.HasPermission(user, db.PermissionValue.CanCreateSubnamespaces) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var req namespaceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ns := &db.Namespace{Name: name}
+	if err := req.apply(ns); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := db.CreateNamespace(ns, user)
+	if err != nil {
+		log.Errorf("Failed to create namespace %s: %v\n", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, namespaceResponse{Namespace: ns, Children: []string{}})
+}
+
+// GetNamespace handles a namespace info request.
+func GetNamespace(w http.ResponseWriter, r *http.Request) {
+	ns := db.GetNamespace(mux.Vars(r)["namespace"])
+	if ns == nil {
+		namespaceNotFound(w, r)
+		return
+	}
+	user := CheckAuth(r)
+	if !ns.HasPermission(user, db.PermissionValue.CanRead) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	children := []string{}
+	for _, child := range ns.GetChildren() {
+		if child.HasPermission(user, db.PermissionValue.CanRead) {
+			children = append(children, child.Name)
+		}
+	}
+	writeJSON(w, http.StatusOK, namespaceResponse{Namespace: ns, Children: children})
+}
+
+// UpdateNamespace handles a namespace update request.
+func UpdateNamespace(w http.ResponseWriter, r *http.Request) {
+	ns := db.GetNamespace(mux.Vars(r)["namespace"])
+	if ns == nil {
+		namespaceNotFound(w, r)
+		return
+	}
+	user := CheckAuth(r)
+	if !ns.HasPermission(user, db.PermissionValue.IsCreator) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var req namespaceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	oldPermissions := ns.DefaultPermissions
+	if err := req.apply(ns); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := ns.Update(); err != nil {
+		log.Errorf("Failed to update namespace %s: %v\n", ns.Name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if ns.DefaultPermissions != oldPermissions {
+		audit(r, user, db.AuditPermissionChanged, db.TypeNamespacePermission.String(), ns.Name,
+			fmt.Sprintf("default permissions changed from %d to %d", oldPermissions, ns.DefaultPermissions))
+	}
+	GetNamespace(w, r)
+}
+
+// DeleteNamespace handles a namespace deletion request. Namespaces that contain files or other
+// namespaces are only deleted if the recursive query parameter is set.
+func DeleteNamespace(w http.ResponseWriter, r *http.Request) {
+	ns := db.GetNamespace(mux.Vars(r)["namespace"])
+	if ns == nil {
+		namespaceNotFound(w, r)
+		return
+	}
+	user := CheckAuth(r)
+	if !ns.HasPermission(user, db.PermissionValue.IsCreator) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	recursive := r.URL.Query().Get("recursive") == "true"
+	if !recursive && (len(ns.GetChildren()) > 0 || ns.HasFiles()) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	deleted := []string{ns.Name}
+	var err error
+	if recursive {
+		deleted, err = ns.DeleteRecursive()
+	} else {
+		err = ns.Delete()
+	}
+	if err != nil {
+		log.Errorf("Failed to delete namespace %s: %v\n", ns.Name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for _, name := range deleted {
+		audit(r, user, db.AuditNamespaceDeleted, db.TypeNamespacePermission.String(), name, "")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type moveNamespaceRequest struct {
+	Name string `json:"name"`
+}
+
+// MoveNamespace handles a namespace rename or move request.
+func MoveNamespace(w http.ResponseWriter, r *http.Request) {
+	ns := db.GetNamespace(mux.Vars(r)["namespace"])
+	if ns == nil {
+		namespaceNotFound(w, r)
+		return
+	}
+	var req moveNamespaceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !db.IsValidNamespaceName(req.Name) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	user := CheckAuth(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if !ns.HasPermission(user, db.PermissionValue.IsCreator) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	parent := db.GetNearestParent(req.Name)
+	if parent == nil && !user.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if parent != nil && !parent.HasPermission(user, db.PermissionValue.CanCreateSubnamespaces) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	oldName := ns.Name
+	err := ns.Move(req.Name, config.NamespaceRedirectDuration)
+	switch err {
+	case nil:
+		log.Infof("%s moved namespace %s to %s\n", user.Email, oldName, ns.Name)
+		audit(r, user, db.AuditNamespaceMoved, db.TypeNamespacePermission.String(), ns.Name, "moved from "+oldName)
+		writeJSON(w, http.StatusOK, namespaceResponse{Namespace: ns, Children: []string{}})
+	case db.ErrNamespaceExists:
+		w.WriteHeader(http.StatusConflict)
+	case db.ErrNoParent, db.ErrNamespaceNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	case db.ErrMoveIntoSelf:
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		log.Errorf("Failed to move namespace %s to %s: %v\n", oldName, req.Name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// namespaceNotFound responds to a request for a namespace that doesn't exist. If the namespace was
+// renamed recently, the client is redirected to the same route with the new name of the namespace.
+func namespaceNotFound(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	target := db.GetNamespaceRedirect(vars["namespace"])
+	if len(target) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	pairs := []string{}
+	for key, value := range vars {
+		if key == "namespace" {
+			value = target
+		}
+		pairs = append(pairs, key, value)
+	}
+	url, err := mux.CurrentRoute(r).URL(pairs...)
+	if err != nil {
+		log.Warnf("Failed to build redirect URL from %s to %s: %v\n", vars["namespace"], target, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	url.RawQuery = r.URL.RawQuery
+	http.Redirect(w, r, url.String(), http.StatusTemporaryRedirect)
+}
@@ -0,0 +1,401 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/auth"
+	"maunium.net/go/mauGFHS/db"
+)
+
+const oidcSessionName = "maugfhs-oidc"
+
+// oidcClockSkew is the amount of clock difference allowed when checking ID token timestamps.
+const oidcClockSkew = time.Minute
+
+// Errors returned when validating ID tokens and mapping them to users.
+var (
+	errInvalidIDToken   = errors.New("invalid ID token")
+	errUnverifiedEmail  = errors.New("email address in ID token is missing or not verified")
+	errUserNotFound     = errors.New("user doesn't exist and auto-provisioning is disabled")
+	errOIDCIssuerChange = errors.New("discovered issuer doesn't match configured issuer")
+)
+
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+// oidcProvider contains the discovered configuration of the OpenID Connect provider.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	keys                  jsonWebKeySet
+	keysFetchedAt         time.Time
+}
+
+var cachedOIDCProvider *oidcProvider
+var oidcLock sync.Mutex
+
+func getJSON(url string, into interface{}) error {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+// getOIDCProvider gets the provider configuration using OpenID Connect discovery. The configuration
+// is cached after the first successful discovery.
+func getOIDCProvider() (*oidcProvider, error) {
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	if cachedOIDCProvider != nil {
+		return cachedOIDCProvider, nil
+	}
+	issuer := strings.TrimSuffix(config.Auth.OIDC.Issuer, "/")
+	provider := &oidcProvider{}
+	err := getJSON(issuer+"/.well-known/openid-configuration", provider)
+	if err != nil {
+		return nil, err
+	} else if strings.TrimSuffix(provider.Issuer, "/") != issuer {
+		return nil, errOIDCIssuerChange
+	}
+	cachedOIDCProvider = provider
+	return provider, nil
+}
+
+// getKey gets the key that was used to sign the given JWT. The key set is fetched again if the key
+// isn't found, as the provider may have rotated its keys.
+func (provider *oidcProvider) getKey(jwt *parsedJWT) (crypto.PublicKey, error) {
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	key, err := provider.keys.Find(jwt)
+	if err == errUnknownJWK && time.Since(provider.keysFetchedAt) > time.Minute {
+		var keys jsonWebKeySet
+		if err = getJSON(provider.JWKSURI, &keys); err != nil {
+			return nil, err
+		}
+		provider.keys = keys
+		provider.keysFetchedAt = time.Now()
+		key, err = provider.keys.Find(jwt)
+	}
+	return key, err
+}
+
+// audience is the aud claim of a JWT, which can be either a single string or an array.
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*aud = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(aud))
+}
+
+func (aud audience) Contains(clientID string) bool {
+	for _, item := range aud {
+		if item == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+type idTokenClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expiry          int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   *bool    `json:"email_verified"`
+	all             map[string]interface{}
+}
+
+// GetGroups gets the groups in the configured groups claim.
+func (claims *idTokenClaims) GetGroups() []string {
+	switch value := claims.all[config.Auth.OIDC.GroupsClaim].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		groups := make([]string, 0, len(value))
+		for _, item := range value {
+			if group, ok := item.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, timestamps and nonce of the given ID token.
+func (provider *oidcProvider) verifyIDToken(token, nonce string) (*idTokenClaims, error) {
+	jwt, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	key, err := provider.getKey(jwt)
+	if err != nil {
+		return nil, err
+	} else if err = jwt.Verify(key); err != nil {
+		return nil, err
+	}
+
+	claims := &idTokenClaims{}
+	if err = json.Unmarshal(jwt.Payload, claims); err != nil {
+		return nil, errInvalidIDToken
+	} else if err = json.Unmarshal(jwt.Payload, &claims.all); err != nil {
+		return nil, errInvalidIDToken
+	}
+	clientID := config.Auth.OIDC.ClientID
+	now := time.Now()
+	switch {
+	case claims.Issuer != provider.Issuer:
+		return nil, fmt.Errorf("%v: unexpected issuer %s", errInvalidIDToken, claims.Issuer)
+	case !claims.Audience.Contains(clientID):
+		return nil, fmt.Errorf("%v: not issued for this client", errInvalidIDToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != clientID:
+		return nil, fmt.Errorf("%v: unexpected authorized party %s", errInvalidIDToken, claims.AuthorizedParty)
+	case time.Unix(claims.Expiry, 0).Add(oidcClockSkew).Before(now):
+		return nil, fmt.Errorf("%v: expired", errInvalidIDToken)
+	case time.Unix(claims.IssuedAt, 0).Add(-oidcClockSkew).After(now):
+		return nil, fmt.Errorf("%v: issued in the future", errInvalidIDToken)
+	case len(nonce) == 0 || claims.Nonce != nonce:
+		return nil, fmt.Errorf("%v: nonce mismatch", errInvalidIDToken)
+	}
+	return claims, nil
+}
+
+// exchangeCode exchanges an authorization code for an ID token.
+func (provider *oidcProvider) exchangeCode(code, verifier string) (string, error) {
+	cfg := config.Auth.OIDC
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", cfg.RedirectURL)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned status %d", resp.StatusCode)
+	}
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", err
+	} else if len(tokenResp.IDToken) == 0 {
+		return "", errInvalidIDToken
+	}
+	return tokenResp.IDToken, nil
+}
+
+// StartOIDCLogin handles a request to log in with OpenID Connect by redirecting the user to the
+// provider. The state, nonce and PKCE code verifier are stored in a short-lived session cookie.
+func StartOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if !config.Auth.OIDC.Enabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	provider, err := getOIDCProvider()
+	if err != nil {
+		log.Errorln("Failed to discover OpenID Connect provider:", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	authURL, err := url.Parse(provider.AuthorizationEndpoint)
+	if err != nil {
+		log.Errorln("Invalid OpenID Connect authorization endpoint:", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	state := db.SecureRandomString(32)
+	nonce := db.SecureRandomString(32)
+	verifier := db.SecureRandomString(64)
+	challenge := sha256.Sum256([]byte(verifier))
+	session, _ := store.Get(r, oidcSessionName)
+	session.Options.MaxAge = 600
+	session.Values["state"] = state
+	session.Values["nonce"] = nonce
+	session.Values["verifier"] = verifier
+	if err = session.Save(r, w); err != nil {
+		log.Errorln("Failed to save OpenID Connect session:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	scopes := config.Auth.OIDC.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email"}
+	}
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", config.Auth.OIDC.ClientID)
+	query.Set("redirect_uri", config.Auth.OIDC.RedirectURL)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+	http.Redirect(w, r, authURL.String(), http.StatusFound)
+}
+
+// FinishOIDCLogin handles the redirect back from the OpenID Connect provider. The authorization code
+// is exchanged for an ID token, which is validated and mapped to a user. The user is logged in by
+// issuing an auth token, or given a login token for FinishTOTPLogin if they have enabled TOTP.
+func FinishOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if !config.Auth.OIDC.Enabled {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	session, _ := store.Get(r, oidcSessionName)
+	state, _ := session.Values["state"].(string)
+	nonce, _ := session.Values["nonce"].(string)
+	verifier, _ := session.Values["verifier"].(string)
+	session.Options.MaxAge = -1
+	session.Save(r, w)
+
+	query := r.URL.Query()
+	if len(state) == 0 || query.Get("state") != state {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if errCode := query.Get("error"); len(errCode) > 0 {
+		log.Debugf("OpenID Connect login failed: %s: %s\n", errCode, query.Get("error_description"))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	provider, err := getOIDCProvider()
+	if err != nil {
+		log.Errorln("Failed to discover OpenID Connect provider:", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	idToken, err := provider.exchangeCode(query.Get("code"), verifier)
+	if err != nil {
+		log.Warnln("Failed to exchange OpenID Connect authorization code:", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	claims, err := provider.verifyIDToken(idToken, nonce)
+	if err != nil {
+		log.Warnln("Rejected OpenID Connect ID token:", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	user, err := getOIDCUser(claims)
+	if err != nil {
+		log.Infof("Rejected OpenID Connect login of %s: %v\n", claims.Subject, err)
+		audit(r, nil, db.AuditLoginFailed, db.AuditTargetUser, claims.Email, "OpenID Connect: "+err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if user.HasTOTP() {
+		loginToken := startPendingLogin(user, "oidc", "OpenID Connect")
+		if len(config.Auth.OIDC.PostLoginRedirect) > 0 {
+			// The login token is passed in the fragment so that it isn't sent to any server.
+			fragment := url.Values{"totpRequired": {"true"}, "loginToken": {loginToken}}
+			http.Redirect(w, r, config.Auth.OIDC.PostLoginRedirect+"#"+fragment.Encode(), http.StatusFound)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"user":         user.Email,
+			"totpRequired": true,
+			"loginToken":   loginToken,
+		})
+		return
+	}
+
+	token, err := startSession(w, r, user, "oidc")
+	if err != nil {
+		log.Errorf("Failed to create auth token for %s: %v\n", user.Email, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Infof("%s logged in with OpenID Connect\n", user.Email)
+	audit(r, user, db.AuditLogin, db.AuditTargetUser, user.Email, "OpenID Connect")
+	if len(config.Auth.OIDC.PostLoginRedirect) > 0 {
+		http.Redirect(w, r, config.Auth.OIDC.PostLoginRedirect, http.StatusFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"user":      user.Email,
+		"authToken": token,
+	})
+}
+
+// getOIDCUser maps the claims of an ID token to a user by email. Users are created if
+// auto-provisioning is enabled, and their admin status and namespace permissions are synced from
+// their groups if the groups claim is configured.
+func getOIDCUser(claims *idTokenClaims) (*db.User, error) {
+	verified := claims.EmailVerified != nil && *claims.EmailVerified
+	if len(claims.Email) == 0 || (!verified && !config.Auth.OIDC.AllowUnverifiedEmail) {
+		return nil, errUnverifiedEmail
+	}
+	user := db.GetUser(claims.Email)
+	if user == nil {
+		if !config.Auth.OIDC.AutoProvision {
+			return nil, errUserNotFound
+		}
+		var err error
+		user, err = db.CreateUser(claims.Email)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Provisioned user %s from OpenID Connect login\n", user.Email)
+	} else if user.ServiceAccount {
+		return nil, errUserNotFound
+	}
+	if len(config.Auth.OIDC.GroupsClaim) > 0 {
+		auth.SyncGroups(user, claims.GetGroups(), config.Auth.OIDC.GroupMapping, "OpenID Connect")
+	}
+	return user, nil
+}
@@ -0,0 +1,227 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testOIDCProvider is an OpenID Connect provider that issues ID tokens with fixed claims for a
+// single authorization code.
+type testOIDCProvider struct {
+	*httptest.Server
+	t      *testing.T
+	key    *ecdsa.PrivateKey
+	issuer string
+	claims map[string]interface{}
+}
+
+const (
+	testOIDCClientID = "maugfhs"
+	testOIDCSecret   = "secret"
+	testOIDCCode     = "code"
+	testOIDCVerifier = "verifier"
+	testOIDCNonce    = "nonce"
+)
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &testOIDCProvider{t: t, key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", provider.discovery)
+	mux.HandleFunc("/jwks", provider.jwks)
+	mux.HandleFunc("/token", provider.token)
+	provider.Server = httptest.NewServer(mux)
+	provider.issuer = provider.URL
+	provider.claims = map[string]interface{}{
+		"iss":            provider.URL,
+		"sub":            "1234",
+		"aud":            testOIDCClientID,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          testOIDCNonce,
+		"email":          "user@example.com",
+		"email_verified": true,
+	}
+
+	config.Auth.OIDC.Issuer = provider.URL
+	config.Auth.OIDC.ClientID = testOIDCClientID
+	config.Auth.OIDC.ClientSecret = testOIDCSecret
+	config.Auth.OIDC.AllowUnverifiedEmail = false
+	cachedOIDCProvider = nil
+	t.Cleanup(func() {
+		provider.Close()
+		cachedOIDCProvider = nil
+	})
+	return provider
+}
+
+func (provider *testOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 provider.issuer,
+		"authorization_endpoint": provider.URL + "/authorize",
+		"token_endpoint":         provider.URL + "/token",
+		"jwks_uri":               provider.URL + "/jwks",
+	})
+}
+
+func (provider *testOIDCProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jsonWebKeySet{Keys: []jsonWebKey{newECJSONWebKey("test", &provider.key.PublicKey)}})
+}
+
+func (provider *testOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok || clientID != testOIDCClientID || secret != testOIDCSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("code") != testOIDCCode ||
+		r.PostFormValue("code_verifier") != testOIDCVerifier {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"id_token": provider.sign(provider.key)})
+}
+
+func (provider *testOIDCProvider) sign(key *ecdsa.PrivateKey) string {
+	token, err := signJWT(provider.claims, "test", key)
+	if err != nil {
+		provider.t.Fatal(err)
+	}
+	return token
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	discovered, err := getOIDCProvider()
+	if err != nil {
+		t.Fatal("Discovery failed:", err)
+	} else if discovered.TokenEndpoint != provider.URL+"/token" {
+		t.Fatalf("Unexpected token endpoint %s", discovered.TokenEndpoint)
+	}
+	idToken, err := discovered.exchangeCode(testOIDCCode, testOIDCVerifier)
+	if err != nil {
+		t.Fatal("Code exchange failed:", err)
+	}
+	claims, err := discovered.verifyIDToken(idToken, testOIDCNonce)
+	if err != nil {
+		t.Fatal("ID token verification failed:", err)
+	} else if claims.Email != "user@example.com" || claims.Subject != "1234" {
+		t.Fatalf("Unexpected claims %+v", claims)
+	}
+}
+
+func TestOIDCCodeExchangeRejected(t *testing.T) {
+	newTestOIDCProvider(t)
+	discovered, err := getOIDCProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = discovered.exchangeCode(testOIDCCode, "wrong verifier"); err == nil {
+		t.Error("Code exchange with wrong verifier succeeded")
+	}
+	config.Auth.OIDC.ClientSecret = "wrong"
+	if _, err = discovered.exchangeCode(testOIDCCode, testOIDCVerifier); err == nil {
+		t.Error("Code exchange with wrong client secret succeeded")
+	}
+}
+
+func TestOIDCIssuerMismatch(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	provider.issuer = "https://evil.example.com"
+	if _, err := getOIDCProvider(); err != errOIDCIssuerChange {
+		t.Fatalf("Expected issuer change error, got %v", err)
+	}
+}
+
+func TestOIDCVerifyIDTokenRejects(t *testing.T) {
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		key    *ecdsa.PrivateKey
+		nonce  string
+	}{
+		{"wrong key", nil, otherKey, testOIDCNonce},
+		{"wrong nonce", nil, nil, "other"},
+		{"empty nonce", map[string]interface{}{"nonce": ""}, nil, ""},
+		{"wrong issuer", map[string]interface{}{"iss": "https://evil.example.com"}, nil, testOIDCNonce},
+		{"wrong audience", map[string]interface{}{"aud": "other"}, nil, testOIDCNonce},
+		{"missing azp", map[string]interface{}{"aud": []string{testOIDCClientID, "other"}}, nil, testOIDCNonce},
+		{"expired", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}, nil, testOIDCNonce},
+		{"future", map[string]interface{}{"iat": time.Now().Add(time.Hour).Unix()}, nil, testOIDCNonce},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := newTestOIDCProvider(t)
+			for claim, value := range test.claims {
+				provider.claims[claim] = value
+			}
+			key := provider.key
+			if test.key != nil {
+				key = test.key
+			}
+			discovered, err := getOIDCProvider()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = discovered.verifyIDToken(provider.sign(key), test.nonce); err == nil {
+				t.Error("Invalid ID token was accepted")
+			}
+		})
+	}
+}
+
+func TestOIDCMultipleAudiences(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	provider.claims["aud"] = []string{"other", testOIDCClientID}
+	provider.claims["azp"] = testOIDCClientID
+	discovered, err := getOIDCProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = discovered.verifyIDToken(provider.sign(provider.key), testOIDCNonce); err != nil {
+		t.Error("ID token with multiple audiences was rejected:", err)
+	}
+}
+
+func TestOIDCUnverifiedEmail(t *testing.T) {
+	newTestOIDCProvider(t)
+	verified := false
+	for _, claims := range []*idTokenClaims{
+		{Email: "user@example.com"},
+		{Email: "user@example.com", EmailVerified: &verified},
+		{},
+	} {
+		if _, err := getOIDCUser(claims); err != errUnverifiedEmail {
+			data, _ := json.Marshal(claims)
+			t.Errorf("Expected unverified email error for %s, got %v", data, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"maunium.net/go/mauGFHS/db"
+)
+
+// ExplainFilePermissionByID handles an ID-based permission explanation request.
+func ExplainFilePermissionByID(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	explainFilePermission(w, r, db.GetFileByID(vars["id"]))
+}
+
+// ExplainFilePermissionByPath handles a path-based permission explanation request.
+func ExplainFilePermissionByPath(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	explainFilePermission(w, r, db.GetFileByPath(vars["namespace"], vars["name"]))
+}
+
+// ExplainNamespacePermission handles a namespace permission explanation request.
+func ExplainNamespacePermission(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ns := db.GetNamespace(vars["namespace"])
+	if ns == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	caller := CheckAuth(r)
+	if caller == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if !ns.HasPermission(caller, db.PermissionValue.IsCreator) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	user, ok := getExplainedUser(w, r, caller)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, db.ResolveNamespacePermission(user, ns))
+}
+
+func explainFilePermission(w http.ResponseWriter, r *http.Request, file *db.File) {
+	if file == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	caller := CheckAuth(r)
+	if caller == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if !file.HasPermission(caller, db.PermissionValue.IsCreator) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	user, ok := getExplainedUser(w, r, caller)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, db.ResolveFilePermission(user, file))
+}
+
+// getExplainedUser gets the user whose permissions should be explained. The user is read from the
+// "user" query parameter, defaulting to the caller. The "anonymous" query parameter can be used to
+// explain the permissions of unauthenticated requests.
+func getExplainedUser(w http.ResponseWriter, r *http.Request, caller *db.User) (*db.User, bool) {
+	query := r.URL.Query()
+	if query.Get("anonymous") == "true" {
+		return nil, true
+	}
+	email := query.Get("user")
+	if len(email) == 0 {
+		return caller, true
+	}
+	user := db.GetUser(email)
+	if user == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+	return user, true
+}
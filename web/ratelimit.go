@@ -0,0 +1,255 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/db"
+)
+
+// The kinds of things failed authentication attempts are tracked for.
+const (
+	limitIP        = "ip"
+	limitAccount   = "account"
+	limitShareLink = "sharelink"
+)
+
+// maxFailureRecords is the maximum number of IP addresses, accounts and share links whose failures
+// are tracked. The records with the oldest failures are dropped when the limit is reached.
+const maxFailureRecords = 100000
+
+// authFailures contains the failed authentication attempts of an IP address or an account.
+type authFailures struct {
+	Type        string     `json:"type"`
+	Key         string     `json:"key"`
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"lastFailure"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"`
+}
+
+// The failure records are kept in a list ordered by the last failure, newest first, so that old
+// records can be pruned and evicted from the back of the list without scanning all records.
+var (
+	failures     = make(map[string]*list.Element)
+	failureOrder = list.New()
+	failuresLock sync.Mutex
+)
+
+// normalizeLimitKey makes account names case-insensitive so that changing the case doesn't bypass
+// the limit.
+func normalizeLimitKey(limitType, key string) string {
+	if limitType == limitAccount {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// clientIPKey gets the client IP address of the given request as a rate limit key. IPv6 addresses
+// are limited by their /64 prefix, as a single client usually has the whole prefix. The key is empty
+// if the address is unknown.
+func clientIPKey(r *http.Request) string {
+	ip := GetClientIP(r)
+	if ip == nil {
+		return ""
+	} else if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String()
+	}
+	return ip.String()
+}
+
+// getLockout gets how long the given IP address or account is still locked.
+func getLockout(limitType, key string) time.Duration {
+	if len(key) == 0 {
+		return 0
+	}
+	key = normalizeLimitKey(limitType, key)
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	elem, ok := failures[limitType+":"+key]
+	if !ok {
+		return 0
+	}
+	record := elem.Value.(*authFailures)
+	if record.LockedUntil == nil {
+		return 0
+	}
+	return time.Until(*record.LockedUntil)
+}
+
+// recordFailure counts a failed authentication attempt of the given IP address, account or share link
+// and locks it if it has gone over the limit. Empty keys are ignored.
+func recordFailure(limitType, key string) {
+	if len(key) == 0 {
+		return
+	}
+	key = normalizeLimitKey(limitType, key)
+	limits := config.Auth.RateLimit
+	allowed := limits.GetIPFailures()
+	if limitType != limitIP {
+		allowed = limits.GetAccountFailures()
+	}
+	now := time.Now()
+
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	pruneFailures(now)
+	var record *authFailures
+	if elem, ok := failures[limitType+":"+key]; ok {
+		record = elem.Value.(*authFailures)
+		failureOrder.MoveToFront(elem)
+	} else {
+		if len(failures) >= maxFailureRecords {
+			removeFailure(failureOrder.Back())
+		}
+		record = &authFailures{Type: limitType, Key: key}
+		failures[limitType+":"+key] = failureOrder.PushFront(record)
+	}
+	record.Failures++
+	record.LastFailure = now
+	if record.Failures > allowed {
+		lockout := limits.GetLockout(record.Failures - allowed)
+		lockedUntil := now.Add(lockout)
+		record.LockedUntil = &lockedUntil
+		log.Warnf("Locked %s %s for %v after %d failed authentication attempts\n", limitType, key, lockout, record.Failures)
+	}
+}
+
+// clearFailures forgets the failed authentication attempts of the given IP address or account.
+func clearFailures(limitType, key string) bool {
+	key = normalizeLimitKey(limitType, key)
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	elem, ok := failures[limitType+":"+key]
+	if ok {
+		removeFailure(elem)
+	}
+	return ok
+}
+
+// removeFailure removes the given failure record. The caller must hold failuresLock.
+func removeFailure(elem *list.Element) {
+	record := failureOrder.Remove(elem).(*authFailures)
+	delete(failures, record.Type+":"+record.Key)
+}
+
+// pruneFailures removes records that are no longer locked and whose last failure is old enough to
+// be forgotten. Only the back of the list is checked, so each record is only looked at once after it
+// can be pruned. The caller must hold failuresLock.
+func pruneFailures(now time.Time) {
+	resetAfter := config.Auth.RateLimit.GetResetAfter()
+	for elem := failureOrder.Back(); elem != nil; elem = failureOrder.Back() {
+		record := elem.Value.(*authFailures)
+		if now.Sub(record.LastFailure) <= resetAfter || (record.LockedUntil != nil && now.Before(*record.LockedUntil)) {
+			break
+		}
+		removeFailure(elem)
+	}
+}
+
+// checkLockout writes a Too Many Requests response if any of the given IP address or account are
+// locked. Empty keys are ignored.
+func checkLockout(w http.ResponseWriter, ip, account string) bool {
+	return writeLockout(w, getLockout(limitIP, ip), getLockout(limitAccount, account))
+}
+
+// checkShareLinkLockout writes a Too Many Requests response if the given IP address or share link
+// are locked.
+func checkShareLinkLockout(w http.ResponseWriter, ip, slug string) bool {
+	return writeLockout(w, getLockout(limitIP, ip), getLockout(limitShareLink, slug))
+}
+
+// writeLockout writes a Too Many Requests response with the longer of the given lockouts, if any.
+func writeLockout(w http.ResponseWriter, lockout, otherLockout time.Duration) bool {
+	if otherLockout > lockout {
+		lockout = otherLockout
+	}
+	if lockout > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(lockout.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// hasAuthHeaders checks if the given request contains an API key or an auth token in the headers.
+// Session cookies are signed, so the tokens in them can't be guessed and aren't counted as failures.
+func hasAuthHeaders(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") ||
+		(len(r.Header.Get("AuthToken")) > 0 && len(r.Header.Get("AuthUser")) > 0)
+}
+
+// limitAuthAttempts rejects requests with credentials from locked IP addresses.
+func limitAuthAttempts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hasAuthHeaders(r) && !checkLockout(w, clientIPKey(r), "") {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ListAuthFailures handles an admin request to list the IP addresses and accounts that have failed
+// authentication attempts.
+func ListAuthFailures(w http.ResponseWriter, r *http.Request) {
+	user := CheckAuth(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if !user.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	failuresLock.Lock()
+	pruneFailures(time.Now())
+	records := make([]authFailures, 0, len(failures))
+	for elem := failureOrder.Front(); elem != nil; elem = elem.Next() {
+		records = append(records, *elem.Value.(*authFailures))
+	}
+	failuresLock.Unlock()
+	writeJSON(w, http.StatusOK, records)
+}
+
+// ClearAuthFailures handles an admin request to unlock an IP address or an account.
+func ClearAuthFailures(w http.ResponseWriter, r *http.Request) {
+	user := CheckAuth(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if !user.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	vars := mux.Vars(r)
+	if !clearFailures(vars["type"], vars["key"]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Infof("Admin %s cleared failed authentication attempts of %s %s\n", user.Email, vars["type"], vars["key"])
+	audit(r, user, db.AuditLockoutCleared, vars["type"], vars["key"], "")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,89 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func resetFailures() {
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	for elem := failureOrder.Front(); elem != nil; elem = failureOrder.Front() {
+		removeFailure(elem)
+	}
+}
+
+func TestClientIPKey(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		key        string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"[2001:db8::1]:1234", "2001:db8::"},
+		{"[2001:db8::ffff:1]:1234", "2001:db8::"},
+		{"[2001:db8:0:1::1]:1234", "2001:db8:0:1::"},
+		{"invalid", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if key := clientIPKey(r); key != test.key {
+			t.Errorf("Expected key %q for %s, got %q", test.key, test.remoteAddr, key)
+		}
+	}
+}
+
+func TestRecordFailureLockout(t *testing.T) {
+	resetFailures()
+	defer resetFailures()
+	allowed := config.Auth.RateLimit.GetAccountFailures()
+	for i := 0; i < allowed; i++ {
+		recordFailure(limitAccount, "Alice")
+	}
+	if lockout := getLockout(limitAccount, "alice"); lockout > 0 {
+		t.Errorf("Account was locked after %d failures", allowed)
+	}
+	recordFailure(limitAccount, "alice")
+	if lockout := getLockout(limitAccount, "ALICE"); lockout <= 0 {
+		t.Error("Account wasn't locked after going over the limit")
+	}
+	if !clearFailures(limitAccount, "alice") || getLockout(limitAccount, "alice") > 0 {
+		t.Error("Clearing the failures didn't unlock the account")
+	}
+}
+
+func TestPruneFailures(t *testing.T) {
+	resetFailures()
+	defer resetFailures()
+	recordFailure(limitIP, "192.0.2.1")
+	recordFailure(limitIP, "192.0.2.2")
+	recordFailure(limitIP, "192.0.2.1")
+
+	failuresLock.Lock()
+	if failureOrder.Front().Value.(*authFailures).Key != "192.0.2.1" {
+		t.Error("Most recent failure isn't at the front of the list")
+	}
+	pruneFailures(time.Now().Add(config.Auth.RateLimit.GetResetAfter() + time.Second))
+	remaining := len(failures)
+	failuresLock.Unlock()
+	if remaining != 0 {
+		t.Errorf("Expected all failures to be pruned, %d remaining", remaining)
+	}
+}
@@ -0,0 +1,150 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/db"
+)
+
+type searchResponse struct {
+	Files   []*db.File `json:"files"`
+	Offset  int        `json:"offset"`
+	Limit   int        `json:"limit"`
+	HasMore bool       `json:"hasMore"`
+}
+
+// SearchFiles handles a file search request. Only files that the caller can read are returned.
+//
+// The query parameters "name" and "mime" are glob patterns for the file name and MIME type. If the
+// name has no wildcards, it's matched as a substring. "minSize" and "maxSize" limit the file size in
+// bytes and "createdAfter", "createdBefore", "updatedAfter" and "updatedBefore" limit the times as
+// RFC 3339 timestamps or unix seconds. "tag", "meta.<key>", "sort", "order", "offset" and "limit"
+// work like in namespace listings. "namespace" limits the search to a namespace and its children.
+// "q" searches the full-text index if it's enabled. Anonymous searches must be limited to a namespace.
+func SearchFiles(w http.ResponseWriter, r *http.Request) {
+	searchFiles(w, r, "name")
+}
+
+// SearchFileContents handles a full-text search request. The "q" query parameter is required and
+// the results are sorted by relevance by default. Otherwise this works like SearchFiles.
+func SearchFileContents(w http.ResponseWriter, r *http.Request) {
+	if len(r.URL.Query().Get("q")) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	searchFiles(w, r, "relevance")
+}
+
+func searchFiles(w http.ResponseWriter, r *http.Request, defaultSort string) {
+	query := r.URL.Query()
+	offset, limit, ok := getPagination(query.Get("offset"), query.Get("limit"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fileQuery, ok := parseFileQuery(query, defaultSort)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if len(fileQuery.Content) > 0 && !db.IsFullTextIndexEnabled() {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	user := CheckAuth(r)
+	if user == nil && len(fileQuery.Subtree) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	fileQuery.FilterReadable = true
+	fileQuery.Reader = user
+	fileQuery.Offset = offset
+	fileQuery.Limit = limit
+	files, hasMore, err := db.SearchFiles(fileQuery)
+	if err != nil {
+		log.Errorln("Failed to search files:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, searchResponse{Files: files, Offset: offset, Limit: limit, HasMore: hasMore})
+}
+
+func parseFileQuery(query url.Values, defaultSort string) (fq db.FileQuery, ok bool) {
+	fq.Content = query.Get("q")
+	fq.SortBy = query.Get("sort")
+	if len(fq.SortBy) == 0 {
+		fq.SortBy = defaultSort
+	}
+	if fq.SortBy == "relevance" {
+		if ok = len(fq.Content) > 0; !ok {
+			return
+		}
+	} else if _, ok = db.FileSortFields[fq.SortBy]; !ok {
+		return
+	}
+	fq.Descending = query.Get("order") == "desc"
+	fq.Subtree = query.Get("namespace")
+	fq.NamePattern = query.Get("name")
+	if len(fq.NamePattern) > 0 && !strings.ContainsAny(fq.NamePattern, "*?") {
+		fq.NamePattern = "*" + fq.NamePattern + "*"
+	}
+	fq.MIMEPattern = query.Get("mime")
+	fq.Tags = query["tag"]
+	fq.Metadata = getMetadataFilter(query)
+
+	if fq.MinSize, ok = parseSize(query.Get("minSize")); !ok {
+		return
+	} else if fq.MaxSize, ok = parseSize(query.Get("maxSize")); !ok {
+		return
+	} else if fq.CreatedAfter, ok = parseTime(query.Get("createdAfter")); !ok {
+		return
+	} else if fq.CreatedBefore, ok = parseTime(query.Get("createdBefore")); !ok {
+		return
+	} else if fq.UpdatedAfter, ok = parseTime(query.Get("updatedAfter")); !ok {
+		return
+	} else if fq.UpdatedBefore, ok = parseTime(query.Get("updatedBefore")); !ok {
+		return
+	}
+	return fq, true
+}
+
+func parseSize(val string) (int64, bool) {
+	if len(val) == 0 {
+		return 0, true
+	}
+	size, err := strconv.ParseInt(val, 10, 64)
+	return size, err == nil && size >= 0
+}
+
+// parseTime parses a RFC 3339 timestamp or unix seconds. Empty strings are parsed as the zero time.
+func parseTime(val string) (time.Time, bool) {
+	if len(val) == 0 {
+		return time.Time{}, true
+	} else if unix, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(unix, 0), true
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	return t, err == nil
+}
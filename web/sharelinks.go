@@ -0,0 +1,344 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/db"
+)
+
+type shareLinkRequest struct {
+	Password string `json:"password"`
+	// The number of seconds until the link expires. Zero means that the link never expires.
+	ExpiresIn int64 `json:"expiresIn"`
+	// Whether or not the link allows uploading files.
+	Upload bool `json:"upload"`
+}
+
+type shareLinkResponse struct {
+	*db.ShareLink
+	HasPassword bool   `json:"hasPassword"`
+	URL         string `json:"url"`
+}
+
+func makeShareLinkResponse(link *db.ShareLink) shareLinkResponse {
+	return shareLinkResponse{
+		ShareLink:   link,
+		HasPassword: link.HasPassword(),
+		URL:         config.Listen.PathPrefix + "/file/share/" + link.Slug,
+	}
+}
+
+// ShareFileByID handles an ID-based share link creation request.
+func ShareFileByID(w http.ResponseWriter, r *http.Request) {
+	shareFile(w, r, db.GetFileByID(mux.Vars(r)["id"]))
+}
+
+// ShareFileByPath handles a path-based share link creation request.
+func ShareFileByPath(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	shareFile(w, r, db.GetFileByPath(vars["namespace"], vars["name"]))
+}
+
+func shareFile(w http.ResponseWriter, r *http.Request, file *db.File) {
+	if !checkFileExists(w, file) {
+		return
+	}
+	user := CheckAuth(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if !file.HasPermission(user, db.PermissionValue.IsCreator) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	createShareLink(w, r, user, db.TypeFilePermission, file.ID)
+}
+
+// ShareNamespace handles a namespace share link creation request.
+func ShareNamespace(w http.ResponseWriter, r *http.Request) {
+	ns := db.GetNamespace(mux.Vars(r)["namespace"])
+	if ns == nil {
+		namespaceNotFound(w, r)
+		return
+	}
+	user := CheckAuth(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if !ns.HasPermission(user, db.PermissionValue.IsCreator) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	createShareLink(w, r, user, db.TypeNamespacePermission, ns.Name)
+}
+
+func createShareLink(w http.ResponseWriter, r *http.Request, user *db.User, targetType db.PermissionTargetType, target string) {
+	var req shareLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ExpiresIn < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	link := &db.ShareLink{
+		TargetType: targetType,
+		Target:     target,
+		Permission: db.PermissionRead,
+		CreatedBy:  user.Email,
+	}
+	if req.Upload {
+		link.Permission = db.PermissionReadWrite
+	}
+	if req.ExpiresIn > 0 {
+		expiry := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+		link.ExpiresAt = &expiry
+	}
+	if err := db.CreateShareLink(link, req.Password); err != nil {
+		log.Errorf("Failed to create share link to %s %s: %v\n", targetType, target, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	audit(r, user, db.AuditTokenCreated, db.AuditTargetShareLink, link.Slug, fmt.Sprintf("share link to %s %s", targetType, target))
+	writeJSON(w, http.StatusCreated, makeShareLinkResponse(link))
+}
+
+// ListShareLinks handles a request to list the share links created by the user. Admins can list the
+// links of other users with the "user" query parameter.
+func ListShareLinks(w http.ResponseWriter, r *http.Request) {
+	user := CheckAuth(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	email := r.URL.Query().Get("user")
+	if len(email) == 0 {
+		email = user.Email
+	} else if email != user.Email && !user.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	links, err := db.GetShareLinksBy(email)
+	if err != nil {
+		log.Errorf("Failed to get share links of %s: %v\n", email, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp := make([]shareLinkResponse, len(links))
+	for i, link := range links {
+		resp[i] = makeShareLinkResponse(link)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// GetShareLink handles a request to view the details of a share link.
+func GetShareLink(w http.ResponseWriter, r *http.Request) {
+	link, _, ok := getManagedShareLink(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, makeShareLinkResponse(link))
+}
+
+// RevokeShareLink handles a share link revocation request.
+func RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	link, user, ok := getManagedShareLink(w, r)
+	if !ok {
+		return
+	}
+	if err := link.Revoke(); err != nil {
+		log.Errorf("Failed to revoke share link %s: %v\n", link.Slug, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	audit(r, user, db.AuditTokenRevoked, db.AuditTargetShareLink, link.Slug, fmt.Sprintf("share link to %s %s", link.TargetType, link.Target))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getManagedShareLink gets the share link in the request and the user if the user is allowed to
+// manage it. Share links can be managed by the user who created them, the creators of the target and
+// admins.
+func getManagedShareLink(w http.ResponseWriter, r *http.Request) (*db.ShareLink, *db.User, bool) {
+	link := db.GetShareLink(mux.Vars(r)["slug"])
+	if link == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil, false
+	}
+	user := CheckAuth(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, nil, false
+	} else if link.CreatedBy == user.Email {
+		return link, user, true
+	}
+	// Links to deleted targets can only be managed by their creator and admins.
+	allowed := user.Admin
+	if file := link.GetFile(); file != nil {
+		allowed = file.HasPermission(user, db.PermissionValue.IsCreator)
+	} else if ns := link.GetNamespace(); ns != nil {
+		allowed = ns.HasPermission(user, db.PermissionValue.IsCreator)
+	}
+	if !allowed {
+		w.WriteHeader(http.StatusForbidden)
+		return nil, nil, false
+	}
+	return link, user, true
+}
+
+// getSharePassword gets the share link password from the X-Share-Password header or the "password"
+// field of a URL-encoded form body. Passwords are never read from the URL, as URLs end up in logs
+// and browser histories.
+func getSharePassword(r *http.Request) string {
+	if password := r.Header.Get("X-Share-Password"); len(password) > 0 {
+		return password
+	}
+	if contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); contentType == "application/x-www-form-urlencoded" {
+		return r.PostFormValue("password")
+	}
+	return ""
+}
+
+// resolveShareLink gets the share link in the request, checks that it's active and that the correct
+// password was given, and counts the access. HEAD requests are not counted. Wrong passwords count as
+// failures of both the client IP address and the link.
+func resolveShareLink(w http.ResponseWriter, r *http.Request) *db.ShareLink {
+	link := db.GetShareLink(mux.Vars(r)["slug"])
+	if link == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	} else if !link.IsActive() {
+		w.WriteHeader(http.StatusGone)
+		return nil
+	}
+	ip := clientIPKey(r)
+	if !checkShareLinkLockout(w, ip, link.Slug) {
+		return nil
+	} else if !link.CheckPassword(getSharePassword(r)) {
+		recordFailure(limitIP, ip)
+		recordFailure(limitShareLink, link.Slug)
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil
+	}
+	if r.Method == http.MethodHead {
+		return link
+	} else if err := link.CountAccess(); err != nil {
+		log.Warnf("Failed to count access to share link %s: %v\n", link.Slug, err)
+	}
+	return link
+}
+
+// resolveSharedNamespace gets the namespace of the share link in the request. If write is true, the
+// link must allow uploads.
+func resolveSharedNamespace(w http.ResponseWriter, r *http.Request, write bool) *db.Namespace {
+	link := resolveShareLink(w, r)
+	if link == nil {
+		return nil
+	} else if link.TargetType != db.TypeNamespacePermission {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	} else if write && !link.Permission.CanWrite() {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+	ns := link.GetNamespace()
+	if ns == nil {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	return ns
+}
+
+// GetSharedFile handles a GET request to a share link. File links send the file and namespace links
+// list the files in the namespace.
+func GetSharedFile(w http.ResponseWriter, r *http.Request) {
+	link := resolveShareLink(w, r)
+	if link == nil {
+		return
+	} else if link.TargetType == db.TypeFilePermission {
+		file := link.GetFile()
+		if checkFileExists(w, file) {
+			serveFile(w, r, file)
+		}
+		return
+	}
+	ns := link.GetNamespace()
+	if ns == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	files, err := db.ListFiles(db.FileQuery{Namespaces: []string{ns.Name}, SortBy: "name"})
+	if err != nil {
+		log.Errorf("Failed to list files in %s: %v\n", ns.Name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, files)
+}
+
+// GetSharedFileByName handles a GET request to a file in a shared namespace.
+func GetSharedFileByName(w http.ResponseWriter, r *http.Request) {
+	ns := resolveSharedNamespace(w, r, false)
+	if ns == nil {
+		return
+	}
+	file := db.GetFileByPath(ns.Name, mux.Vars(r)["name"])
+	if checkFileExists(w, file) {
+		serveFile(w, r, file)
+	}
+}
+
+// UpdateSharedFile handles a PUT request to a file share link that allows uploads.
+func UpdateSharedFile(w http.ResponseWriter, r *http.Request) {
+	link := resolveShareLink(w, r)
+	if link == nil {
+		return
+	} else if link.TargetType != db.TypeFilePermission {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	} else if !link.Permission.CanWrite() {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	file := link.GetFile()
+	if checkFileExists(w, file) {
+		writeUpload(w, r, file.GetNamespace(), file, file.Name, nil, nil)
+	}
+}
+
+// UpdateSharedFileByName handles a PUT request to a file in a shared namespace that allows uploads.
+func UpdateSharedFileByName(w http.ResponseWriter, r *http.Request) {
+	ns := resolveSharedNamespace(w, r, true)
+	if ns == nil {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	writeUpload(w, r, ns, db.GetFileByPath(ns.Name, name), name, nil, nil)
+}
+
+// UploadSharedFile handles a POST request that creates a new file with a server-generated name in a
+// shared namespace that allows uploads.
+func UploadSharedFile(w http.ResponseWriter, r *http.Request) {
+	ns := resolveSharedNamespace(w, r, true)
+	if ns != nil {
+		writeUpload(w, r, ns, nil, "", nil, nil)
+	}
+}
@@ -0,0 +1,360 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/db"
+)
+
+// signedURL contains the parameters of a pre-signed URL. Signed URLs allow a single request of a
+// single kind to a single path without authentication until they expire. The request is made on
+// behalf of the user who signed the URL, so it fails if the signer no longer has access.
+type signedURL struct {
+	Method    string
+	Path      string
+	ExpiresAt time.Time
+	// The email of the user who signed the URL.
+	Signer string
+	// A random value that identifies the URL when it's used or revoked.
+	Nonce string
+	// The maximum size of uploaded files. Zero means that only the limits of the namespace apply.
+	MaxLength int64
+	// A glob pattern that the MIME type of uploaded files must match. Empty means any MIME type.
+	MIME string
+}
+
+// Errors returned by getSignedURL.
+var (
+	errSignedURLsDisabled = errors.New("signed URLs are disabled")
+	errInvalidSignature   = errors.New("invalid signature")
+	errSignatureExpired   = errors.New("signed URL has expired")
+	errSignatureUsed      = errors.New("signed URL has already been used or revoked")
+)
+
+func (su *signedURL) signature() string {
+	mac := hmac.New(sha256.New, []byte(config.SignedURLs.Key))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%d\n%s\n%s\n%s", su.Method, su.Path, su.ExpiresAt.Unix(), su.MaxLength, su.MIME, su.Signer, su.Nonce)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns the path of this signed URL with the signature and constraints in the query string.
+func (su *signedURL) URL() string {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(su.ExpiresAt.Unix(), 10))
+	if su.MaxLength > 0 {
+		query.Set("maxLength", strconv.FormatInt(su.MaxLength, 10))
+	}
+	if len(su.MIME) > 0 {
+		query.Set("mime", su.MIME)
+	}
+	query.Set("signer", su.Signer)
+	query.Set("nonce", su.Nonce)
+	query.Set("signature", su.signature())
+	return su.Path + "?" + query.Encode()
+}
+
+// AllowsMIME checks if files with the given MIME type may be uploaded with this signed URL.
+func (su *signedURL) AllowsMIME(mime string) bool {
+	if len(su.MIME) == 0 {
+		return true
+	}
+	match, _ := path.Match(su.MIME, mime)
+	return match
+}
+
+// getSignedURL reads and verifies the signed URL parameters of the given request and marks the URL
+// as used. The signer of the URL is returned too, and the caller must check that they still have the
+// permissions the URL was signed with. If the request doesn't have a signature, nil is returned
+// without an error. HEAD requests are accepted with signatures for GET requests.
+func getSignedURL(r *http.Request) (*signedURL, *db.User, error) {
+	query := r.URL.Query()
+	if len(query.Get("signature")) == 0 {
+		return nil, nil, nil
+	}
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	su, err := parseSignedURL(method, r.URL.Path, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer := db.GetUser(su.Signer)
+	if signer == nil {
+		return nil, nil, errInvalidSignature
+	}
+	unused, err := db.UseSignedURL(su.Nonce, su.ExpiresAt)
+	if err != nil {
+		log.Errorf("Failed to mark signed URL to %s as used: %v\n", su.Path, err)
+		return nil, nil, err
+	} else if !unused {
+		return nil, nil, errSignatureUsed
+	}
+	setRequestUser(r, signer)
+	return su, signer, nil
+}
+
+// parseSignedURL reads the signed URL parameters from the given query and verifies the signature
+// for the given method and path.
+func parseSignedURL(method, urlPath string, query url.Values) (*signedURL, error) {
+	if len(config.SignedURLs.Key) == 0 {
+		return nil, errSignedURLsDisabled
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return nil, errInvalidSignature
+	}
+	var maxLength int64
+	if maxLengthStr := query.Get("maxLength"); len(maxLengthStr) > 0 {
+		maxLength, err = strconv.ParseInt(maxLengthStr, 10, 64)
+		if err != nil {
+			return nil, errInvalidSignature
+		}
+	}
+	su := &signedURL{
+		Method:    method,
+		Path:      urlPath,
+		ExpiresAt: time.Unix(expires, 0),
+		Signer:    query.Get("signer"),
+		Nonce:     query.Get("nonce"),
+		MaxLength: maxLength,
+		MIME:      query.Get("mime"),
+	}
+	if len(su.Signer) == 0 || len(su.Nonce) != signedURLNonceLength {
+		return nil, errInvalidSignature
+	} else if !hmac.Equal([]byte(su.signature()), []byte(query.Get("signature"))) {
+		return nil, errInvalidSignature
+	} else if su.ExpiresAt.Before(time.Now()) {
+		return nil, errSignatureExpired
+	}
+	return su, nil
+}
+
+type signRequest struct {
+	Method string `json:"method"`
+	// The number of seconds the URL should be valid for.
+	ExpiresIn int64  `json:"expiresIn"`
+	MaxLength int64  `json:"maxLength"`
+	MIME      string `json:"mime"`
+}
+
+type signResponse struct {
+	URL       string    `json:"url"`
+	Method    string    `json:"method"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// SignFileURLByID handles a request to sign an ID-based GET or PUT URL.
+func SignFileURLByID(w http.ResponseWriter, r *http.Request) {
+	req, user, ok := readSignRequest(w, r)
+	if !ok {
+		return
+	}
+	file := db.GetFileByID(mux.Vars(r)["id"])
+	if file == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if !checkSignPermission(w, req.Method, user, file) || !checkFileExists(w, file) {
+		return
+	}
+	writeSignedURL(w, r, user, req, config.Listen.PathPrefix+"/file/direct/"+file.ID)
+}
+
+// SignFileURLByPath handles a request to sign a path-based GET or PUT URL. PUT URLs can be signed for
+// files that don't exist yet.
+func SignFileURLByPath(w http.ResponseWriter, r *http.Request) {
+	req, user, ok := readSignRequest(w, r)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	ns := db.GetNamespace(vars["namespace"])
+	if ns == nil {
+		namespaceNotFound(w, r)
+		return
+	}
+	file := db.GetFileByPath(ns.Name, vars["name"])
+	var target permissionChecker
+	if req.Method == http.MethodPut && (file == nil || file.IsGone()) {
+		target = ns
+	} else if file == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else {
+		target = file
+	}
+	if !checkSignPermission(w, req.Method, user, target) || (file != nil && req.Method != http.MethodPut && !checkFileExists(w, file)) {
+		return
+	}
+	writeSignedURL(w, r, user, req, config.Listen.PathPrefix+"/file/"+ns.Name+"/"+vars["name"])
+}
+
+// SignNamespaceURL handles a request to sign a POST URL for uploading a file with a server-generated
+// name to a namespace.
+func SignNamespaceURL(w http.ResponseWriter, r *http.Request) {
+	req, user, ok := readSignRequest(w, r)
+	if !ok {
+		return
+	}
+	ns := db.GetNamespace(mux.Vars(r)["namespace"])
+	if ns == nil {
+		namespaceNotFound(w, r)
+		return
+	}
+	if len(req.Method) == 0 {
+		req.Method = http.MethodPost
+	} else if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !ns.HasPermission(user, db.PermissionValue.CanWrite) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	writeSignedURL(w, r, user, req, config.Listen.PathPrefix+"/file/"+ns.Name)
+}
+
+// readSignRequest authenticates the user and reads the body of a URL signing request.
+func readSignRequest(w http.ResponseWriter, r *http.Request) (*signRequest, *db.User, bool) {
+	if len(config.SignedURLs.Key) == 0 {
+		w.WriteHeader(http.StatusNotImplemented)
+		return nil, nil, false
+	}
+	user := CheckAuth(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, nil, false
+	}
+	var req signRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ExpiresIn <= 0 || req.MaxLength < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, nil, false
+	} else if _, err = path.Match(req.MIME, ""); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, nil, false
+	} else if maxDuration := config.SignedURLs.MaxDuration; maxDuration > 0 && time.Duration(req.ExpiresIn)*time.Second > maxDuration {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, nil, false
+	}
+	return &req, user, true
+}
+
+// checkSignPermission checks that the user has the permissions required to sign a file URL with the
+// given method.
+func checkSignPermission(w http.ResponseWriter, method string, user *db.User, target permissionChecker) bool {
+	var check func(db.PermissionValue) bool
+	switch method {
+	case http.MethodGet:
+		check = db.PermissionValue.CanRead
+	case http.MethodPut:
+		check = db.PermissionValue.CanWrite
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	allowed := target.HasPermission(user, check)
+	if !allowed {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	return allowed
+}
+
+// signedURLNonceLength is the length of the random nonces of signed URLs.
+const signedURLNonceLength = 32
+
+func writeSignedURL(w http.ResponseWriter, r *http.Request, user *db.User, req *signRequest, urlPath string) {
+	su := &signedURL{
+		Method:    req.Method,
+		Path:      urlPath,
+		ExpiresAt: time.Now().Add(time.Duration(req.ExpiresIn) * time.Second),
+		Signer:    user.Email,
+		Nonce:     db.SecureRandomString(signedURLNonceLength),
+		MaxLength: req.MaxLength,
+		MIME:      req.MIME,
+	}
+	audit(r, user, db.AuditTokenCreated, db.AuditTargetSignedURL, urlPath, fmt.Sprintf("%s until %s", su.Method, su.ExpiresAt.Format(time.RFC3339)))
+	writeJSON(w, http.StatusOK, signResponse{
+		URL:       su.URL(),
+		Method:    su.Method,
+		ExpiresAt: su.ExpiresAt,
+	})
+}
+
+type revokeSignedURLRequest struct {
+	URL    string `json:"url"`
+	Method string `json:"method"`
+}
+
+// RevokeSignedURL handles a request to revoke a signed URL before it's used. The request contains the
+// URL and method returned when the URL was signed. Signed URLs can be revoked by the user who signed
+// them and admins.
+func RevokeSignedURL(w http.ResponseWriter, r *http.Request) {
+	if len(config.SignedURLs.Key) == 0 {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	user := CheckAuth(r)
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var req revokeSignedURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	parsed, err := url.Parse(req.URL)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	su, err := parseSignedURL(req.Method, parsed.Path, parsed.Query())
+	if err == errSignatureExpired {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if su.Signer != user.Email && !user.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	unused, err := db.UseSignedURL(su.Nonce, su.ExpiresAt)
+	if err != nil {
+		log.Errorf("Failed to revoke signed URL to %s: %v\n", su.Path, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if unused {
+		audit(r, user, db.AuditTokenRevoked, db.AuditTargetSignedURL, su.Path, fmt.Sprintf("%s signed by %s", su.Method, su.Signer))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
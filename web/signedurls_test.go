@@ -0,0 +1,76 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func parseTestSignedURL(t *testing.T, method, signed string) (*signedURL, error) {
+	parsed, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseSignedURL(method, parsed.Path, parsed.Query())
+}
+
+func TestSignedURLRoundTrip(t *testing.T) {
+	config.SignedURLs.Key = "test key"
+	defer func() { config.SignedURLs.Key = "" }()
+	su := &signedURL{
+		Method:    http.MethodPut,
+		Path:      "/file/test/file.txt",
+		ExpiresAt: time.Now().Add(time.Minute),
+		Signer:    "alice@example.com",
+		Nonce:     "abcdefghijklmnopqrstuvwxyz012345",
+		MaxLength: 1024,
+		MIME:      "text/*",
+	}
+	parsed, err := parseTestSignedURL(t, su.Method, su.URL())
+	if err != nil {
+		t.Fatal("Valid signed URL was rejected:", err)
+	} else if parsed.Signer != su.Signer || parsed.Nonce != su.Nonce || parsed.MaxLength != su.MaxLength || parsed.MIME != su.MIME {
+		t.Errorf("Unexpected signed URL parameters %+v", parsed)
+	}
+
+	if _, err = parseTestSignedURL(t, http.MethodGet, su.URL()); err != errInvalidSignature {
+		t.Errorf("Expected invalid signature for wrong method, got %v", err)
+	}
+	for param, value := range map[string]string{"signer": "mallory@example.com", "nonce": "abcdefghijklmnopqrstuvwxyz012346", "maxLength": "2048"} {
+		parsed, _ := url.Parse(su.URL())
+		query := parsed.Query()
+		query.Set(param, value)
+		if _, err = parseSignedURL(su.Method, parsed.Path, query); err != errInvalidSignature {
+			t.Errorf("Expected invalid signature for modified %s, got %v", param, err)
+		}
+	}
+
+	su.ExpiresAt = time.Now().Add(-time.Minute)
+	if _, err = parseTestSignedURL(t, su.Method, su.URL()); err != errSignatureExpired {
+		t.Errorf("Expected expired signature, got %v", err)
+	}
+}
+
+func TestSignedURLDisabled(t *testing.T) {
+	su := &signedURL{Method: http.MethodGet, Path: "/file/test/file.txt", ExpiresAt: time.Now().Add(time.Minute)}
+	if _, err := parseTestSignedURL(t, su.Method, su.URL()); err != errSignedURLsDisabled {
+		t.Errorf("Expected signed URLs to be disabled, got %v", err)
+	}
+}
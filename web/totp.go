@@ -0,0 +1,180 @@
+// mauGFHS - A server that can serve as a backend for many kinds of services that only require file hosting.
+// Copyright (C) 2017 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "maunium.net/go/maulogger"
+
+	"maunium.net/go/mauGFHS/db"
+)
+
+type totpRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// GetTOTPStatus handles a request to check whether or not the user has enabled TOTP. Admins can
+// check other users with the "user" query parameter.
+func GetTOTPStatus(w http.ResponseWriter, r *http.Request) {
+	user := getKeyManager(w, r)
+	if user == nil {
+		return
+	}
+	target := user
+	if email := r.URL.Query().Get("user"); len(email) > 0 && email != user.Email {
+		if !user.Admin {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		} else if target = db.GetUser(email); target == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user":    target.Email,
+		"enabled": target.HasTOTP(),
+	})
+}
+
+// EnrollTOTP handles a request to start enrolling TOTP. The response contains the secret and the
+// provisioning URI for authenticator apps. TOTP isn't required until it's enabled with EnableTOTP.
+func EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user := getKeyManager(w, r)
+	if user == nil {
+		return
+	} else if user.ServiceAccount {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if user.HasTOTP() {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	totp, err := user.EnrollTOTP()
+	if err != nil {
+		log.Errorf("Failed to enroll TOTP for %s: %v\n", user.Email, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{
+		"secret": totp.Secret,
+		"uri":    totp.ProvisioningURI(config.Auth.TOTP.GetIssuer()),
+	})
+}
+
+// EnableTOTP handles a request to finish enrolling TOTP by verifying a code from the authenticator
+// app. The response contains the recovery codes of the user.
+func EnableTOTP(w http.ResponseWriter, r *http.Request) {
+	user := getKeyManager(w, r)
+	if user == nil {
+		return
+	}
+	var req totpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	totp := user.GetTOTP()
+	if totp == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if totp.Enabled {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if !totp.Verify(req.Code) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err := totp.Enable(); err != nil {
+		log.Errorf("Failed to enable TOTP for %s: %v\n", user.Email, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Infof("%s enabled TOTP\n", user.Email)
+	audit(r, user, db.AuditTOTPEnabled, db.AuditTargetUser, user.Email, "")
+	writeRecoveryCodes(w, user)
+}
+
+// RegenerateRecoveryCodes handles a request to replace the recovery codes of the user. The request
+// must contain a current TOTP code.
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := getKeyManager(w, r)
+	if user == nil {
+		return
+	}
+	var req totpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if !user.HasTOTP() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if !checkSecondFactor(user, req.Code, "") {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	writeRecoveryCodes(w, user)
+}
+
+func writeRecoveryCodes(w http.ResponseWriter, user *db.User) {
+	codes, err := user.GenerateRecoveryCodes()
+	if err != nil {
+		log.Errorf("Failed to generate recovery codes for %s: %v\n", user.Email, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"recoveryCodes": codes})
+}
+
+// DisableTOTP handles a request to disable TOTP. Users must confirm with a TOTP code or a recovery
+// code. Admins can disable TOTP of other users with the "user" query parameter, e.g. if they've lost
+// their authenticator and recovery codes.
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	user := getKeyManager(w, r)
+	if user == nil {
+		return
+	}
+	target := user
+	if email := r.URL.Query().Get("user"); len(email) > 0 && email != user.Email {
+		if !user.Admin {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		} else if target = db.GetUser(email); target == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	} else {
+		var req totpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if user.HasTOTP() && !checkSecondFactor(user, req.Code, req.RecoveryCode) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	if err := target.DisableTOTP(); err != nil {
+		log.Errorf("Failed to disable TOTP for %s: %v\n", target.Email, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Infof("%s disabled TOTP of %s\n", user.Email, target.Email)
+	audit(r, user, db.AuditTOTPDisabled, db.AuditTargetUser, target.Email, "")
+	w.WriteHeader(http.StatusNoContent)
+}
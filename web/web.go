@@ -17,9 +17,13 @@
 package web
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	log "maunium.net/go/maulogger"
@@ -33,15 +37,74 @@ var config = configpkg.MainConfig
 
 // Open opens the HTTP server.
 func Open() {
+	initSessionStore()
 	mainRouter := mux.NewRouter()
 	r := mainRouter.PathPrefix(config.Listen.PathPrefix).Subrouter()
-	r.Methods(http.MethodGet).Path("/file/direct/{id:[a-zA-Z0-9]{32}}").HandlerFunc(GetFileByID)
-	r.Methods(http.MethodGet).Path("/file/{namespace:[a-zA-Z0-9\\/]+}/{name}").HandlerFunc(GetFileByPath)
+	r.Methods(http.MethodGet, http.MethodHead).Path("/file/direct/{id:[a-zA-Z0-9]{32}}").HandlerFunc(GetFileByID)
+	r.Methods(http.MethodGet, http.MethodHead).Path("/file/share/{slug:[a-zA-Z0-9]{32}}").HandlerFunc(GetSharedFile)
+	r.Methods(http.MethodGet, http.MethodHead).Path("/file/share/{slug:[a-zA-Z0-9]{32}}/{name}").HandlerFunc(GetSharedFileByName)
+	r.Methods(http.MethodPut).Path("/file/share/{slug:[a-zA-Z0-9]{32}}").HandlerFunc(UpdateSharedFile)
+	r.Methods(http.MethodPut).Path("/file/share/{slug:[a-zA-Z0-9]{32}}/{name}").HandlerFunc(UpdateSharedFileByName)
+	r.Methods(http.MethodPost).Path("/file/share/{slug:[a-zA-Z0-9]{32}}").HandlerFunc(UploadSharedFile)
+	r.Methods(http.MethodGet, http.MethodHead).Path("/file/{namespace:[a-zA-Z0-9\\/]+}/{name}").HandlerFunc(GetFileByPath)
 	r.Methods(http.MethodPut).Path("/file/direct/{id:[a-zA-Z0-9]{32}}").HandlerFunc(UpdateFileByID)
 	r.Methods(http.MethodPut).Path("/file/{namespace:[a-zA-Z0-9\\/]+}/{name}").HandlerFunc(UpdateFileByPath)
+	r.Methods(http.MethodPost).Path("/file/{namespace:[a-zA-Z0-9\\/]+}").HandlerFunc(UploadFile)
+	r.Methods(http.MethodDelete).Path("/file/direct/{id:[a-zA-Z0-9]{32}}").HandlerFunc(DeleteFileByID)
+	r.Methods(http.MethodDelete).Path("/file/{namespace:[a-zA-Z0-9\\/]+}/{name}").HandlerFunc(DeleteFileByPath)
+	r.Methods(http.MethodPost).Path("/move/file/direct/{id:[a-zA-Z0-9]{32}}").HandlerFunc(MoveFileByID)
+	r.Methods(http.MethodPost).Path("/move/file/{namespace:[a-zA-Z0-9\\/]+}/{name}").HandlerFunc(MoveFileByPath)
+	r.Methods(http.MethodPost).Path("/copy/file/direct/{id:[a-zA-Z0-9]{32}}").HandlerFunc(CopyFileByID)
+	r.Methods(http.MethodPost).Path("/copy/file/{namespace:[a-zA-Z0-9\\/]+}/{name}").HandlerFunc(CopyFileByPath)
+	r.Methods(http.MethodGet).Path("/meta/file/direct/{id:[a-zA-Z0-9]{32}}").HandlerFunc(GetFileMetadataByID)
+	r.Methods(http.MethodGet).Path("/meta/file/{namespace:[a-zA-Z0-9\\/]+}/{name}").HandlerFunc(GetFileMetadataByPath)
+	r.Methods(http.MethodPatch).Path("/meta/file/direct/{id:[a-zA-Z0-9]{32}}").HandlerFunc(UpdateFileMetadataByID)
+	r.Methods(http.MethodPatch).Path("/meta/file/{namespace:[a-zA-Z0-9\\/]+}/{name}").HandlerFunc(UpdateFileMetadataByPath)
+	r.Methods(http.MethodPost).Path("/namespace/{namespace:[a-zA-Z0-9\\/]+}").HandlerFunc(CreateNamespace)
+	r.Methods(http.MethodGet).Path("/namespace/{namespace:[a-zA-Z0-9\\/]+}").HandlerFunc(GetNamespace)
+	r.Methods(http.MethodPatch).Path("/namespace/{namespace:[a-zA-Z0-9\\/]+}").HandlerFunc(UpdateNamespace)
+	r.Methods(http.MethodDelete).Path("/namespace/{namespace:[a-zA-Z0-9\\/]+}").HandlerFunc(DeleteNamespace)
+	r.Methods(http.MethodPost).Path("/move/namespace/{namespace:[a-zA-Z0-9\\/]+}").HandlerFunc(MoveNamespace)
+	r.Methods(http.MethodPost).Path("/share/file/direct/{id:[a-zA-Z0-9]{32}}").HandlerFunc(ShareFileByID)
+	r.Methods(http.MethodPost).Path("/share/file/{namespace:[a-zA-Z0-9\\/]+}/{name}").HandlerFunc(ShareFileByPath)
+	r.Methods(http.MethodPost).Path("/share/namespace/{namespace:[a-zA-Z0-9\\/]+}").HandlerFunc(ShareNamespace)
+	r.Methods(http.MethodGet).Path("/shares").HandlerFunc(ListShareLinks)
+	r.Methods(http.MethodGet).Path("/share/{slug:[a-zA-Z0-9]{32}}").HandlerFunc(GetShareLink)
+	r.Methods(http.MethodDelete).Path("/share/{slug:[a-zA-Z0-9]{32}}").HandlerFunc(RevokeShareLink)
+	r.Methods(http.MethodPost).Path("/sign/file/direct/{id:[a-zA-Z0-9]{32}}").HandlerFunc(SignFileURLByID)
+	r.Methods(http.MethodPost).Path("/sign/file/{namespace:[a-zA-Z0-9\\/]+}/{name}").HandlerFunc(SignFileURLByPath)
+	r.Methods(http.MethodPost).Path("/sign/namespace/{namespace:[a-zA-Z0-9\\/]+}").HandlerFunc(SignNamespaceURL)
+	r.Methods(http.MethodPost).Path("/sign/revoke").HandlerFunc(RevokeSignedURL)
+	r.Methods(http.MethodPost).Path("/login").HandlerFunc(Login)
+	r.Methods(http.MethodPost).Path("/login/totp").HandlerFunc(FinishTOTPLogin)
+	r.Methods(http.MethodPost).Path("/token").HandlerFunc(IssueAccessToken)
+	r.Methods(http.MethodPost).Path("/token/refresh").HandlerFunc(RefreshAccessToken)
+	r.Methods(http.MethodPost).Path("/token/revoke").HandlerFunc(RevokeRefreshToken)
+	r.Methods(http.MethodGet).Path("/.well-known/jwks.json").HandlerFunc(GetJWKS)
+	r.Methods(http.MethodGet).Path("/login/oidc").HandlerFunc(StartOIDCLogin)
+	r.Methods(http.MethodGet).Path("/login/oidc/callback").HandlerFunc(FinishOIDCLogin)
+	r.Methods(http.MethodPost).Path("/apikeys").HandlerFunc(CreateAPIKey)
+	r.Methods(http.MethodGet).Path("/apikeys").HandlerFunc(ListAPIKeys)
+	r.Methods(http.MethodDelete).Path("/apikeys/{id:[a-zA-Z0-9]{16}}").HandlerFunc(DeleteAPIKey)
+	r.Methods(http.MethodGet).Path("/totp").HandlerFunc(GetTOTPStatus)
+	r.Methods(http.MethodPost).Path("/totp").HandlerFunc(EnrollTOTP)
+	r.Methods(http.MethodDelete).Path("/totp").HandlerFunc(DisableTOTP)
+	r.Methods(http.MethodPost).Path("/totp/enable").HandlerFunc(EnableTOTP)
+	r.Methods(http.MethodPost).Path("/totp/recoverycodes").HandlerFunc(RegenerateRecoveryCodes)
+	r.Methods(http.MethodGet).Path("/authfailures").HandlerFunc(ListAuthFailures)
+	r.Methods(http.MethodDelete).Path("/authfailures/{type:ip|account|sharelink}/{key}").HandlerFunc(ClearAuthFailures)
+	r.Methods(http.MethodGet).Path("/audit").HandlerFunc(ListAuditEvents)
+	r.Methods(http.MethodGet).Path("/audit/export").HandlerFunc(ExportAuditLog)
+	r.Methods(http.MethodPost).Path("/serviceaccounts").HandlerFunc(CreateServiceAccount)
+	r.Methods(http.MethodGet).Path("/search").HandlerFunc(SearchFiles)
+	r.Methods(http.MethodGet).Path("/search/content").HandlerFunc(SearchFileContents)
+	r.Methods(http.MethodGet).Path("/list/{namespace:[a-zA-Z0-9\\/]+}").HandlerFunc(ListNamespace)
+	r.Methods(http.MethodGet).Path("/permissions/file/direct/{id:[a-zA-Z0-9]{32}}").HandlerFunc(ExplainFilePermissionByID)
+	r.Methods(http.MethodGet).Path("/permissions/file/{namespace:[a-zA-Z0-9\\/]+}/{name}").HandlerFunc(ExplainFilePermissionByPath)
+	r.Methods(http.MethodGet).Path("/permissions/namespace/{namespace:[a-zA-Z0-9\\/]+}").HandlerFunc(ExplainNamespacePermission)
 
 	server := &http.Server{
-		Handler:      mainRouter,
+		Handler:      limitAuthAttempts(recordAdminOverrides(mainRouter)),
 		Addr:         fmt.Sprintf("%s:%d", config.Listen.Address, config.Listen.Port),
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
@@ -59,7 +122,12 @@ func GetFileByID(w http.ResponseWriter, r *http.Request) {
 // GetFileByPath handles a path-based GET request.
 func GetFileByPath(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	getFile(w, r, db.GetFileByPath(vars["namespace"], vars["name"]))
+	file := db.GetFileByPath(vars["namespace"], vars["name"])
+	if file == nil && db.GetNamespace(vars["namespace"]) == nil {
+		namespaceNotFound(w, r)
+		return
+	}
+	getFile(w, r, file)
 }
 
 // UpdateFileByID handles an ID-based PUT request.
@@ -70,79 +138,372 @@ func UpdateFileByID(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	updateFile(w, r, file.GetNamespace(), file)
+	updateFile(w, r, file.GetNamespace(), file, file.Name, false)
 }
 
-// UpdateFileByPath handles a path-based PUT request.
+// UpdateFileByPath handles a path-based PUT request. Expired files and files that have run out of
+// downloads are replaced with a new file.
 func UpdateFileByPath(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	updateFile(w, r, db.GetNamespace(vars["namespace"]), db.GetFileByPath(vars["namespace"], vars["name"]))
+	updateFile(w, r, db.GetNamespace(vars["namespace"]), db.GetFileByPath(vars["namespace"], vars["name"]), vars["name"], true)
+}
+
+// UploadFile handles a POST request that creates a new file with a server-generated name.
+func UploadFile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	updateFile(w, r, db.GetNamespace(vars["namespace"]), nil, "", false)
 }
 
-func updateFile(w http.ResponseWriter, r *http.Request, ns *db.Namespace, file *db.File) {
+// multipartOverhead is the amount of extra bytes allowed in upload requests on top of the maximum
+// file size to account for the multipart encoding.
+const multipartOverhead = 1 << 20
+
+// updateFile writes the uploaded data to the given file. If the file is nil, a new file is created
+// in the given namespace. The name of the new file is generated by the server if the given name is
+// empty or the namespace policy requires it. If replaceGone is true, a file that has expired or run
+// out of downloads is replaced with a new file, otherwise the request fails. Requests made with a
+// valid signed URL are made on behalf of the user who signed it.
+func updateFile(w http.ResponseWriter, r *http.Request, ns *db.Namespace, file *db.File, name string, replaceGone bool) {
 	if ns == nil {
-		w.WriteHeader(http.StatusNotFound)
+		namespaceNotFound(w, r)
 		return
 	}
-	if file == nil {
-		file = ns.CreateFile("name")
+	signed, user, err := getSignedURL(r)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if signed == nil {
+		user = CheckAuth(r)
 	}
-	user := CheckAuth(r)
-	if file != nil {
-		if !file.GetPermissionsFor(user).CanWrite() {
-			w.WriteHeader(http.StatusForbidden)
-			return
-		}
-	} else if !ns.GetPermissionsFor(user).CanWrite() {
+	var target permissionChecker = ns
+	if file != nil && !(replaceGone && file.IsGone()) {
+		target = file
+	}
+	if !target.HasPermission(user, db.PermissionValue.CanWrite) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
+	if file != nil && !replaceGone && !checkFileExists(w, file) {
+		return
+	}
+	writeUpload(w, r, ns, file, name, user, signed)
+}
 
-	r.ParseMultipartForm(32 << 20)
+// writeUpload writes the file uploaded in the given request into the given file, or a new file if
+// the file is nil. If the file has expired or run out of downloads, it's deleted and replaced with a
+// new file. The upload policy of the namespace is enforced, but the permissions of the user must be
+// checked before calling this. If the request was made with a signed URL, the constraints of the URL
+// are enforced too.
+func writeUpload(w http.ResponseWriter, r *http.Request, ns *db.Namespace, file *db.File, name string, user *db.User, signed *signedURL) {
+	var gone *db.File
+	if file != nil && file.IsGone() {
+		gone, file, name = file, nil, file.Name
+	}
+	if file != nil && !ns.CanOverwrite() {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if file == nil && len(name) > 0 && ns.ShouldGenerateNames() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	fileData, _, err := r.FormFile("upload")
-	if err != nil {
+	maxSize := ns.GetMaxFileSize()
+	if signed != nil && signed.MaxLength > 0 && (maxSize <= 0 || signed.MaxLength < maxSize) {
+		maxSize = signed.MaxLength
+	}
+	if maxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize+multipartOverhead)
+	}
+	err := r.ParseMultipartForm(32 << 20)
+	if isBodyTooLarge(err) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	fileData, header, err := r.FormFile("upload")
+	if isBodyTooLarge(err) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	defer fileData.Close()
 
 	data, err := ioutil.ReadAll(fileData)
 	if err != nil {
 		log.Errorln("Failed to read data in form file!")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
+	} else if maxSize > 0 && int64(len(data)) > maxSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, tags, ok := getUploadMetadata(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	expiry, hasExpiry, ok := getUploadExpiry(r, ns)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	maxDownloads, hasMaxDownloads, ok := getUploadMaxDownloads(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if file == nil && len(name) == 0 {
+		name = ns.GenerateFileName(header.Filename)
+	}
+	if file == nil && !ns.IsNameAllowed(name) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if file != nil && !ns.IsExtensionAllowed(file.Name) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
 	mime := http.DetectContentType(data)
-	if !file.GetNamespace().IsMIMEAllowed(mime) {
+	if !ns.IsMIMEAllowed(mime) || (signed != nil && !signed.AllowsMIME(mime)) {
 		w.WriteHeader(http.StatusUnsupportedMediaType)
 		return
 	}
 
-	err = file.Write(data, mime)
+	if gone != nil {
+		if err = gone.Delete(); err != nil {
+			log.Errorf("Failed to delete unavailable file %s: %v\n", gone.Path(), err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		audit(r, user, db.AuditFileDeleted, db.TypeFilePermission.String(), gone.Path(), "expired or out of downloads, replaced by upload")
+	}
+
+	status := http.StatusOK
+	if file == nil {
+		file, err = ns.CreateFile(name, user)
+		if err != nil {
+			log.Errorf("Failed to create file %s/%s: %v\n", ns.Name, name, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		status = http.StatusCreated
+	}
+
+	err = file.Write(data, mime, user)
 	if err != nil {
 		log.Errorln("Failed to write file!")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if metadata != nil {
+		err = file.UpdateMetadata(metadata)
+	}
+	if err == nil && tags != nil {
+		err = file.SetTags(tags)
+	}
+	if err == nil && hasExpiry {
+		err = file.SetExpiry(expiry)
+	}
+	if err == nil && hasMaxDownloads {
+		err = file.SetMaxDownloads(maxDownloads)
+	}
+	if err != nil {
+		log.Errorf("Failed to set metadata of %s: %v\n", file.Path(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	action, details := db.AuditFileUploaded, ""
+	if status == http.StatusOK {
+		action = db.AuditFileOverwritten
+	}
+	if signed != nil {
+		details = "signed URL"
+	}
+	audit(r, user, action, db.TypeFilePermission.String(), file.Path(), details)
+	writeJSON(w, status, file)
+}
+
+// isBodyTooLarge checks if the given error was caused by the request body exceeding the limit set
+// with http.MaxBytesReader.
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return err != nil && (errors.As(err, &maxBytesErr) || strings.Contains(err.Error(), "request body too large"))
+}
+
+// getUploadExpiry reads the optional "ttl" form field of an upload request. The TTL is given in
+// seconds and is capped at the maximum TTL of the namespace. Zero means that the file never expires,
+// unless the namespace has a default or maximum TTL, which is used instead. If the field is not set,
+// new files get the default TTL of the namespace and overwritten files keep their old expiry.
+func getUploadExpiry(r *http.Request, ns *db.Namespace) (expiry *time.Time, hasExpiry, ok bool) {
+	ttlStr := r.FormValue("ttl")
+	if len(ttlStr) == 0 {
+		return nil, false, true
+	}
+	seconds, err := strconv.ParseInt(ttlStr, 10, 64)
+	if err != nil || seconds < 0 {
+		return nil, false, false
+	}
+	ttl := db.SecondsToDuration(seconds)
+	if ttl == 0 {
+		ttl = ns.GetDefaultTTL()
+	}
+	ttl = ns.CapTTL(ttl)
+	if ttl == 0 {
+		return nil, true, true
+	}
+	expiryTime := time.Now().Add(ttl)
+	return &expiryTime, true, true
 }
 
+// getUploadMaxDownloads reads the optional "maxDownloads" form field of an upload request. Zero
+// means that the number of downloads is not limited.
+func getUploadMaxDownloads(r *http.Request) (maxDownloads int, hasMaxDownloads, ok bool) {
+	maxDownloadsStr := r.FormValue("maxDownloads")
+	if len(maxDownloadsStr) == 0 {
+		return 0, false, true
+	}
+	maxDownloads, err := strconv.Atoi(maxDownloadsStr)
+	if err != nil || maxDownloads < 0 {
+		return 0, false, false
+	}
+	return maxDownloads, true, true
+}
+
+// getUploadMetadata reads the optional custom metadata and tags from the "metadata" and "tags" form
+// fields of an upload request. Both fields are JSON encoded.
+func getUploadMetadata(r *http.Request) (metadata map[string]*string, tags []string, ok bool) {
+	if metadataStr := r.FormValue("metadata"); len(metadataStr) > 0 {
+		if json.Unmarshal([]byte(metadataStr), &metadata) != nil || db.ValidateMetadata(metadata) != nil {
+			return nil, nil, false
+		}
+	}
+	if tagsStr := r.FormValue("tags"); len(tagsStr) > 0 {
+		if json.Unmarshal([]byte(tagsStr), &tags) != nil || db.ValidateTags(tags) != nil {
+			return nil, nil, false
+		}
+	}
+	return metadata, tags, true
+}
+
+// getFile sends the data of the given file. Both GET and HEAD requests are handled, and conditional
+// and range requests are supported using the hash of the file as the ETag and the modification time
+// as Last-Modified. GET requests that get the full file are counted as downloads, and files are
+// deleted after their last allowed download. Requests made with a valid signed URL are made on behalf
+// of the user who signed it.
 func getFile(w http.ResponseWriter, r *http.Request, file *db.File) {
 	if file == nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	user := CheckAuth(r)
-	if !file.GetPermissionsFor(user).CanRead() {
-		w.WriteHeader(403)
+	signed, user, err := getSignedURL(r)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if signed == nil {
+		user = CheckAuth(r)
+	}
+	if !file.HasPermission(user, db.PermissionValue.CanRead) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	} else if !checkFileExists(w, file) {
 		return
 	}
-	data, err := file.Read()
+	serveFile(w, r, file)
+}
+
+// serveFile sends the data of the given file without checking permissions. Range requests are
+// ignored for files with a download limit, so that each counted download is a complete one.
+func serveFile(w http.ResponseWriter, r *http.Request, file *db.File) {
+	data, err := file.Open()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Errorf("Failed to read file %s: %v\n", file.Path(), err)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(data)
+	defer data.Close()
+	w.Header().Set("Content-Type", file.MIME)
+	if len(file.Hash) > 0 {
+		w.Header().Set("ETag", `"`+file.Hash+`"`)
+	}
+	if r.Method != http.MethodGet {
+		http.ServeContent(w, r, file.Name, file.UpdatedAt, data)
+		return
+	} else if file.MaxDownloads > 0 {
+		r.Header.Del("Range")
+	}
+
+	dw := &downloadWriter{ResponseWriter: w, file: file}
+	http.ServeContent(dw, r, file.Name, file.UpdatedAt, data)
+	if dw.counted && file.HasRunOutOfDownloads() {
+		err = file.Delete()
+		if err != nil {
+			log.Errorf("Failed to delete %s after last download: %v\n", file.Path(), err)
+		} else {
+			audit(r, nil, db.AuditFileDeleted, db.TypeFilePermission.String(), file.Path(), "last download")
+		}
+	}
+}
+
+var errDownloadRefused = errors.New("download refused")
+
+// downloadWriter counts a download of a file when the full file is about to be sent, which means
+// that conditional requests that are answered with 304 Not Modified and partial responses are not
+// counted. If the file has run out of downloads, 410 Gone is sent instead.
+type downloadWriter struct {
+	http.ResponseWriter
+	file        *db.File
+	wroteHeader bool
+	counted     bool
+	refused     bool
+}
+
+func (dw *downloadWriter) WriteHeader(status int) {
+	if dw.wroteHeader {
+		return
+	}
+	dw.wroteHeader = true
+	if dw.file.MaxDownloads > 0 {
+		dw.Header().Del("Accept-Ranges")
+	}
+	if status == http.StatusOK {
+		counted, err := dw.file.CountDownload()
+		if err != nil {
+			log.Errorf("Failed to count download of %s: %v\n", dw.file.Path(), err)
+			status = http.StatusInternalServerError
+		} else if !counted {
+			status = http.StatusGone
+		}
+		dw.counted = counted
+		dw.refused = !counted
+		if dw.refused {
+			dw.Header().Del("Content-Length")
+			dw.Header().Del("Content-Type")
+			dw.Header().Del("ETag")
+			dw.Header().Del("Last-Modified")
+		}
+	}
+	dw.ResponseWriter.WriteHeader(status)
+}
+
+func (dw *downloadWriter) Write(data []byte) (int, error) {
+	if !dw.wroteHeader {
+		dw.WriteHeader(http.StatusOK)
+	}
+	if dw.refused {
+		return 0, errDownloadRefused
+	}
+	return dw.ResponseWriter.Write(data)
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Errorln("Failed to write JSON response:", err)
+	}
 }